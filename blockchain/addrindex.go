@@ -0,0 +1,152 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// The address index is keyed by public key hash. For every address it keeps
+// its unspent outputs and one history entry per transaction that paid or
+// spent from it, holding the change in the address balance.
+//
+//	addru-<pubkeyhash><txid><output index> -> output
+//	addrh-<pubkeyhash><height><txid>       -> balance change
+var (
+	addrUTXOPrefix    = []byte("addru-")
+	addrHistoryPrefix = []byte("addrh-")
+)
+
+// HistoryEntry is one transaction touching an address.
+type HistoryEntry struct {
+	Height int
+	TxID   []byte
+	Delta  int
+}
+
+func addrUTXOKey(pubKeyHash, txID []byte, outIdx int) []byte {
+	key := prefixedKey(addrUTXOPrefix, pubKeyHash)
+	key = append(key, txID...)
+	return binary.BigEndian.AppendUint32(key, uint32(outIdx))
+}
+
+func addrHistoryKey(pubKeyHash []byte, height int, txID []byte) []byte {
+	key := prefixedKey(addrHistoryPrefix, pubKeyHash)
+	key = binary.BigEndian.AppendUint64(key, uint64(height))
+	return append(key, txID...)
+}
+
+// indexTransaction adds tx to the address index. spent holds the outputs
+// consumed by its inputs, in input order. Outputs with a non-standard script
+// have no address and are left out.
+func indexTransaction(txn Txn, height int, tx *Transaction, spent []TxOutput) error {
+	deltas := make(map[string]int)
+	for i, out := range spent {
+		if out.PubKeyHash() == nil {
+			continue
+		}
+		in := tx.Inputs[i]
+		if err := txn.Delete(addrUTXOKey(out.PubKeyHash(), in.ID, in.OutIndex)); err != nil {
+			return err
+		}
+		deltas[string(out.PubKeyHash())] -= out.Value
+	}
+	for outIdx, out := range tx.Outputs {
+		if out.PubKeyHash() == nil {
+			continue
+		}
+		if err := txn.Set(addrUTXOKey(out.PubKeyHash(), tx.ID, outIdx), out.Serialize()); err != nil {
+			return err
+		}
+		deltas[string(out.PubKeyHash())] += out.Value
+	}
+	for pubKeyHash, delta := range deltas {
+		key := addrHistoryKey([]byte(pubKeyHash), height, tx.ID)
+		if err := txn.Set(key, ToHex(int64(delta))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexTransaction reverts indexTransaction.
+func unindexTransaction(txn Txn, height int, tx *Transaction, spent []TxOutput) error {
+	for outIdx, out := range tx.Outputs {
+		if out.PubKeyHash() == nil {
+			continue
+		}
+		if err := txn.Delete(addrUTXOKey(out.PubKeyHash(), tx.ID, outIdx)); err != nil {
+			return err
+		}
+		if err := txn.Delete(addrHistoryKey(out.PubKeyHash(), height, tx.ID)); err != nil {
+			return err
+		}
+	}
+	for i, out := range spent {
+		if out.PubKeyHash() == nil {
+			continue
+		}
+		in := tx.Inputs[i]
+		if err := txn.Set(addrUTXOKey(out.PubKeyHash(), in.ID, in.OutIndex), out.Serialize()); err != nil {
+			return err
+		}
+		if err := txn.Delete(addrHistoryKey(out.PubKeyHash(), height, tx.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachAddressUTXO calls fn with every unspent output locked to pubKeyHash,
+// and whether the next block may spend it.
+func (u UTXOSet) forEachAddressUTXO(pubKeyHash []byte, fn func(txID string, outIdx int, out TxOutput, mature bool) bool) {
+	prefix := prefixedKey(addrUTXOPrefix, pubKeyHash)
+	err := u.Blockchain.Database.View(func(txn Txn) error {
+		lastHash, err := getLastHash(txn)
+		if err != nil {
+			return err
+		}
+		tip, err := getBlock(txn, lastHash)
+		if err != nil {
+			return err
+		}
+
+		err = txn.Scan(prefix, func(k, v []byte) error {
+			k = k[len(prefix):]
+			txID := k[:len(k)-4]
+			outIdx := int(binary.BigEndian.Uint32(k[len(k)-4:]))
+			outs, err := getOutputs(txn, prefixedKey(utxoPrefix, txID))
+			if err != nil {
+				return err
+			}
+			if !fn(hex.EncodeToString(txID), outIdx, DeserializeOutput(v), outs.IsMature(tip.Height+1)) {
+				return errStopScan
+			}
+			return nil
+		})
+		if err == errStopScan {
+			return nil
+		}
+		return err
+	})
+	HandleError(err)
+}
+
+// AddressHistory returns every transaction that touched pubKeyHash, oldest
+// first.
+func (u UTXOSet) AddressHistory(pubKeyHash []byte) []HistoryEntry {
+	var history []HistoryEntry
+	prefix := prefixedKey(addrHistoryPrefix, pubKeyHash)
+	err := u.Blockchain.Database.View(func(txn Txn) error {
+		return txn.Scan(prefix, func(k, v []byte) error {
+			k = k[len(prefix):]
+			history = append(history, HistoryEntry{
+				Height: int(binary.BigEndian.Uint64(k[:8])),
+				TxID:   k[8:],
+				Delta:  int(int64(binary.BigEndian.Uint64(v))),
+			})
+			return nil
+		})
+	})
+	HandleError(err)
+	return history
+}
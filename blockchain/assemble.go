@@ -0,0 +1,56 @@
+package blockchain
+
+import (
+	"fmt"
+	"sort"
+)
+
+// coinbaseReserve is the room kept in a block for its header and coinbase
+// when choosing transactions.
+const coinbaseReserve = 1000
+
+// SelectTransactions chooses the transactions of a new block from txs, whose
+// fees are given in the same order. Transactions paying the most per byte go
+// first, and selection stops adding transactions that would take the block
+// past Params.MaxBlockSize or Params.MaxBlockTransactions. Of transactions
+// spending the same output only the first chosen is kept. It returns the
+// chosen transactions and their total fee.
+func SelectTransactions(txs []*Transaction, fees []int) ([]*Transaction, int) {
+	type candidate struct {
+		tx   *Transaction
+		fee  int
+		size int
+	}
+	candidates := make([]candidate, len(txs))
+	for i, tx := range txs {
+		candidates[i] = candidate{tx, fees[i], len(tx.Serialize())}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].fee*candidates[j].size > candidates[j].fee*candidates[i].size
+	})
+
+	var selected []*Transaction
+	spent := make(map[string]bool)
+	size, total := coinbaseReserve, 0
+Candidates:
+	for _, c := range candidates {
+		if len(selected)+1 >= Params.MaxBlockTransactions {
+			break
+		}
+		if size+c.size > Params.MaxBlockSize {
+			continue
+		}
+		for _, in := range c.tx.Inputs {
+			if spent[fmt.Sprintf("%x:%d", in.ID, in.OutIndex)] {
+				continue Candidates
+			}
+		}
+		for _, in := range c.tx.Inputs {
+			spent[fmt.Sprintf("%x:%d", in.ID, in.OutIndex)] = true
+		}
+		selected = append(selected, c.tx)
+		size += c.size
+		total += c.fee
+	}
+	return selected, total
+}
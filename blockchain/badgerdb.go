@@ -0,0 +1,125 @@
+package blockchain
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+)
+
+// badgerStorage is a Storage backed by a badger database.
+type badgerStorage struct {
+	db *badger.DB
+}
+
+// OpenBadger opens the badger database in dir, creating it if needed.
+func OpenBadger(dir string) (Storage, error) {
+	db, err := openDB(dir, badger.DefaultOptions(dir))
+	if err != nil {
+		return nil, err
+	}
+	return badgerStorage{db}, nil
+}
+
+func (s badgerStorage) View(fn func(txn Txn) error) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+}
+
+func (s badgerStorage) Update(fn func(txn Txn) error) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+}
+
+func (s badgerStorage) NewWriteBatch() WriteBatch {
+	return badgerWriteBatch{s.db.NewWriteBatch()}
+}
+
+func (s badgerStorage) Close() error {
+	return s.db.Close()
+}
+
+type badgerTxn struct {
+	txn *badger.Txn
+}
+
+func (t badgerTxn) Get(key []byte) ([]byte, error) {
+	item, err := t.txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func (t badgerTxn) Set(key, value []byte) error {
+	return t.txn.Set(key, value)
+}
+
+func (t badgerTxn) Delete(key []byte) error {
+	return t.txn.Delete(key)
+}
+
+func (t badgerTxn) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	it := t.txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		v, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if err := fn(it.Item().KeyCopy(nil), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type badgerWriteBatch struct {
+	wb *badger.WriteBatch
+}
+
+func (b badgerWriteBatch) Set(key, value []byte) error {
+	return b.wb.Set(key, value)
+}
+
+func (b badgerWriteBatch) Flush() error {
+	return b.wb.Flush()
+}
+
+func (b badgerWriteBatch) Cancel() {
+	b.wb.Cancel()
+}
+
+func retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
+	lockPath := filepath.Join(dir, "LOCK")
+	if err := os.Remove(lockPath); err != nil {
+		return nil, fmt.Errorf(`removing "LOCK": %s`, err)
+	}
+	retryOpts := originalOpts
+	retryOpts.Truncate = true
+	db, err := badger.Open(retryOpts)
+	return db, err
+}
+
+func openDB(dir string, opts badger.Options) (*badger.DB, error) {
+	if db, err := badger.Open(opts); err != nil {
+		if strings.Contains(err.Error(), "LOCK") {
+			if db, err := retry(dir, opts); err == nil {
+				log.Println("database unlocked, value log truncated")
+				return db, nil
+			}
+			log.Println("could not unlock database:", err)
+		}
+		return nil, err
+	} else {
+		return db, nil
+	}
+}
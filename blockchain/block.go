@@ -1,62 +1,106 @@
 package blockchain
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
 	"log"
 	"time"
 )
 
 type Block struct {
-	Timestamp int64
+	BlockHeader
 	Hash []byte
+	// Signature is the authority's signature of Hash on proof-of-authority
+	// chains and empty otherwise.
+	Signature    []byte
 	Transactions []*Transaction
-	PrevHash []byte
-	Nonce int
-	Height int
 }
 
 func (b *Block) HashTransactions() []byte {
-	var txHashes [][]byte
+	return b.MerkleTree().Root.Data
+}
+
+// MerkleTree builds the merkle tree over the IDs of the block's transactions.
+func (b *Block) MerkleTree() *MerkleTree {
+	var txIDs [][]byte
 
 	for _, tx := range b.Transactions {
-		txHashes = append(txHashes, tx.Serialize())
+		txIDs = append(txIDs, tx.ID)
 	}
-	tree := NewMerkleTree(txHashes)
-	return tree.Root.Data
+	return NewMerkleTree(txIDs)
 }
 
-func GenesisBlock(coinbase *Transaction) *Block {
-	return NewBlock([]*Transaction{coinbase}, []byte{}, 0)
+func GenesisBlock(coinbase *Transaction, engine Engine) *Block {
+	return NewBlock([]*Transaction{coinbase}, []byte{}, 0, Params.InitialDifficulty, time.Now().Unix(), engine)
 }
 
 
-func NewBlock(txs []*Transaction, prevHash []byte, height int) *Block {
-	block := &Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height}
-	// block.SetHash()
-	pow := NewProofOfWork(block)
-	nonce, hash := pow.Run()
-
-	block.Hash = hash[:]
-	block.Nonce = nonce
+func NewBlock(txs []*Transaction, prevHash []byte, height, difficulty int, timestamp int64, engine Engine) *Block {
+	header := BlockHeader{
+		Version:    BlockVersion,
+		PrevHash:   prevHash,
+		Timestamp:  timestamp,
+		Difficulty: difficulty,
+		Height:     height,
+	}
+	block := &Block{BlockHeader: header, Transactions: txs}
+	block.MerkleRoot = block.HashTransactions()
+	HandleError(engine.Seal(context.Background(), block))
 	return block
 }
 
-func (b *Block) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
+// Mine searches for a nonce that satisfies the block's difficulty using the
+// given number of workers, then sets the nonce and hash. The timestamp may be
+// moved forward if no nonce works. Mine returns ctx's error if it is
+// cancelled first.
+func (b *Block) Mine(ctx context.Context, workers int) error {
+	pow := NewProofOfWork(b)
+	nonce, hash, err := pow.Run(ctx, workers)
+	if err != nil {
+		return err
+	}
+	b.Hash = hash
+	b.Nonce = nonce
+	return nil
+}
 
-	err := encoder.Encode(b)
-	HandleError(err)
-	return res.Bytes()
+// Serialize returns the canonical encoding of the block, described in
+// encoding.go.
+func (b *Block) Serialize() []byte {
+	data := b.BlockHeader.Serialize()
+	data = appendBytes(data, b.Signature)
+	data = appendUint32(data, uint32(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		data = appendBytes(data, tx.Serialize())
+	}
+	return data
 }
 
+// Deserialize decodes a block and sets its hash and the IDs of its
+// transactions.
 func Deserialize(data []byte) *Block {
-	var block Block
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&block)
+	block, err := DecodeBlock(data)
 	HandleError(err)
-	return &block
+	return block
+}
+
+// DecodeBlock is Deserialize for data that may be malformed.
+func DecodeBlock(data []byte) (*Block, error) {
+	r := &reader{data: data}
+	block := &Block{BlockHeader: readHeader(r), Signature: r.bytes()}
+	count := r.count(4)
+	for i := 0; i < count; i++ {
+		txReader := &reader{data: r.bytes()}
+		tx := readTransaction(txReader)
+		if err := txReader.finish(); err != nil && r.err == nil {
+			r.err = err
+		}
+		block.Transactions = append(block.Transactions, &tx)
+	}
+	if err := r.finish(); err != nil {
+		return nil, err
+	}
+	block.Hash = block.BlockHeader.Hash()
+	return block, nil
 }
 
 func HandleError(err error) {
@@ -2,26 +2,49 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
+	"math/big"
 	"os"
-	"path/filepath"
 	"runtime"
-	"strings"
-
-	"github.com/dgraph-io/badger"
+	"sync"
 )
 
 const (
-	dbPath = "./tmp/blocks_%s"
 	genesisData = "Genesis Block"
+	// ChainVersion is the format of the stored chain. Databases written in
+	// an older format cannot be loaded and must be recreated.
+	ChainVersion = 6
 )
+
+var chainVersionKey = []byte("chainversion")
+
+var ErrChainVersion = errors.New("unsupported storage format")
+
+// BlockChain is a chain of blocks stored in Database, with the UTXO set and
+// indexes of its main chain.
 type BlockChain struct {
 	LastHash []byte
-	Database *badger.DB
+	Database Storage
+	// TxIndex is set when the database maintains the transaction index.
+	TxIndex bool
+	// Engine seals and verifies the blocks of the chain. It is recorded in
+	// the database when the chain is created.
+	Engine Engine
+	// PruneDepth is how many of the latest blocks keep their transactions,
+	// or 0 if no block is pruned.
+	PruneDepth int
+
+	history *historyValidator
+	// assumeValidChain holds the hashes of the assume-valid block and its
+	// ancestors by height, once the assume-valid block is stored.
+	assumeValidChain [][]byte
+	assumeValidMu    sync.Mutex
 }
 
 func DBExists(path string) bool {
@@ -31,60 +54,96 @@ func DBExists(path string) bool {
 	return true
 }
 
-func (bc *BlockChain) AddBlock(block *Block) {
-	err := bc.Database.Update(func(txn *badger.Txn) error {
+// AddBlock validates block and stores it. If the branch it extends now
+// carries more cumulative proof-of-work than the current tip, the chain is
+// reorganized onto it, which validates the transactions of every block
+// being connected. Branches below an assume-valid block that is not stored
+// yet wait for it, see ChainParams.AssumeValid. Rejected blocks are reported
+// as a *BlockError, and storage failures are returned as they are.
+func (bc *BlockChain) AddBlock(block *Block) error {
+	if err := CheckBlock(bc.Engine, block); err != nil {
+		return err
+	}
+	// A block from the future may become valid later, so it is rejected
+	// without being marked invalid.
+	if block.Timestamp > AdjustedTime()+Params.MaxFutureDrift {
+		return blockError(block, ErrTimeTooNew)
+	}
+	if bc.wantsHistoricalBlock(block) {
+		return bc.addHistoricalBlock(block)
+	}
+
+	var newTip []byte
+	err := bc.Database.Update(func(txn Txn) error {
 		if _, err := txn.Get(block.Hash); err == nil {
 			return nil
 		}
+		if err := checkBlockContext(txn, block); err != nil {
+			return err
+		}
 
-		blockData := block.Serialize()
-		err := txn.Set(block.Hash, blockData)
-		HandleError(err)
-
-		item, err := txn.Get([]byte("lh"))
-		HandleError(err)
-		var lastHash []byte
-		err = item.Value(func(val []byte) error {
-			lastHash = append([]byte{}, val...)
-			return nil
-		})
-		HandleError(err)
-
-		item, err = txn.Get(lastHash)
-		HandleError(err)
-		var lastBlockData []byte
-		err = item.Value(func(val []byte) error {
-			lastBlockData = append([]byte{}, val...)
-			return nil
-		})
-		HandleError(err)
-
-		lastBlock := Deserialize(lastBlockData)
+		parentWork, err := getChainWork(txn, block.PrevHash)
+		if err != nil {
+			return err
+		}
+		if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+			return err
+		}
+		work := new(big.Int).Add(parentWork, bc.Engine.Work(block))
+		if err := setChainWork(txn, block.Hash, work); err != nil {
+			return err
+		}
 
-		if block.Height > lastBlock.Height {
-			err = txn.Set([]byte("lh"), block.Hash)
-			HandleError(err)
-			bc.LastHash = block.Hash
+		lastHash, err := getLastHash(txn)
+		if err != nil {
+			return err
+		}
+		tipWork, err := getChainWork(txn, lastHash)
+		if err != nil {
+			return err
 		}
 
+		waiting, err := awaitsAssumeValid(txn, block)
+		if err != nil {
+			return err
+		}
+		if work.Cmp(tipWork) > 0 && !waiting {
+			if err := bc.reorganize(txn, lastHash, block); err != nil {
+				return err
+			}
+			newTip = block.Hash
+		}
 		return nil
 	})
-	HandleError(err)
+
+	var blockErr *BlockError
+	if errors.As(err, &blockErr) {
+		if !errors.Is(err, ErrOrphanBlock) {
+			if markErr := bc.markInvalid(blockErr.Hash); markErr != nil {
+				return markErr
+			}
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if newTip != nil {
+		bc.LastHash = newTip
+		if _, err := bc.Prune(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (bc *BlockChain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
 
-	err := bc.Database.View(func(txn *badger.Txn) error {
-		if item, err := txn.Get(blockHash); err != nil {
+	err := bc.Database.View(func(txn Txn) error {
+		if blockData, err := txn.Get(blockHash); err != nil {
 			return errors.New("Block is not found")
 		} else {
-			var blockData []byte
-			err = item.Value(func(val []byte) error {
-				blockData = append([]byte{}, val...)
-				return nil
-			})
-			HandleError(err)
 			block = *Deserialize(blockData)
 		}
 		return nil
@@ -96,29 +155,15 @@ func (bc *BlockChain) GetBlock(blockHash []byte) (Block, error) {
 	return block, nil
 }
 
-
 func (bc *BlockChain) GetBestHeight() int {
 	var lastBlock Block
 
-	err := bc.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
+	err := bc.Database.View(func(txn Txn) error {
+		lastHash, err := txn.Get([]byte("lh"))
 		HandleError(err)
-		var lastHash []byte
-		err = item.Value(func(val []byte) error {
-			lastHash = append([]byte{}, val...)
-			return nil
-		})
-		if err != nil {
-			return err
-		}
 
-		item, err = txn.Get(lastHash)
+		lastBlockData, err := txn.Get(lastHash)
 		HandleError(err)
-		var lastBlockData []byte
-		err = item.Value(func(val []byte) error {
-			lastBlockData = append([]byte{}, val...)
-			return nil
-		})
 
 		lastBlock = *Deserialize(lastBlockData)
 
@@ -147,267 +192,329 @@ func (bc *BlockChain) GetBlockHashes() [][]byte {
 	return blocks
 }
 
-func (bc *BlockChain) MineBlock(transactions []*Transaction) *Block{
-	var lastHash []byte
-	var lastHeight int
-	for _, tx := range transactions {
-		if !bc.VerifyTransaction(tx) {
-			log.Panic("Invalid Transaction")
+// MineBlock validates transactions on top of the current tip, mines a block
+// containing them and adds it to the chain. The first transaction must be
+// the coinbase. The block is sealed by the chain's engine, which stops with
+// ctx's error if ctx is cancelled, for example because another block has
+// replaced the tip.
+func (bc *BlockChain) MineBlock(ctx context.Context, transactions []*Transaction) (*Block, error) {
+	var parent *Block
+	var difficulty int
+	var mtp int64
+	err := bc.Database.View(func(txn Txn) error {
+		lastHash, err := getLastHash(txn)
+		if err != nil {
+			return err
 		}
-	}
-	err := bc.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		HandleError(err)
-		if err = item.Value(func (val []byte) error {
-			lastHash = append([]byte{}, val...)
-			return nil
-		}); err != nil {
+		if parent, err = getBlock(txn, lastHash); err != nil {
 			return err
 		}
-		item, err = txn.Get(lastHash)
-		HandleError(err)
-		err = item.Value(func(val []byte) error {
-			block := Deserialize(val)
-			lastHeight = block.Height
+		if mtp, err = medianTimePast(txn, parent); err != nil {
 			return err
-		})
-		HandleError(err)
-		return nil
+		}
+		difficulty, err = nextDifficulty(txn, parent)
+		return err
 	})
 	HandleError(err)
-	newBlock := NewBlock(transactions, lastHash, lastHeight+1)
-	err = bc.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
-		HandleError(err)
-		err = txn.Set([]byte("lh"), newBlock.Hash)
-		bc.LastHash = newBlock.Hash
+
+	// Blocks mined within the same second still need increasing median
+	// times, so the timestamp is at least one past the median time past.
+	timestamp := max(AdjustedTime(), mtp+1)
+	header := BlockHeader{
+		Version:    BlockVersion,
+		PrevHash:   parent.Hash,
+		Timestamp:  timestamp,
+		Height:     parent.Height + 1,
+		Difficulty: difficulty,
+	}
+	candidate := &Block{BlockHeader: header, Transactions: transactions}
+	if err := bc.checkCandidate(candidate); err != nil {
+		return nil, err
+	}
+
+	candidate.MerkleRoot = candidate.HashTransactions()
+	if err := bc.Engine.Seal(ctx, candidate); err != nil {
+		return nil, err
+	}
+	if err := bc.AddBlock(candidate); err != nil {
+		return nil, err
+	}
+	return candidate, nil
+}
+
+// errDryRun discards the transaction of checkCandidate once the candidate
+// has been connected.
+var errDryRun = errors.New("dry run")
+
+// checkCandidate runs every validation step except proof-of-work against an
+// unmined block, connecting it in a transaction that is then discarded.
+func (bc *BlockChain) checkCandidate(block *Block) error {
+	if err := checkBlockBody(block); err != nil {
 		return err
+	}
+	err := bc.Database.Update(func(txn Txn) error {
+		if err := checkBlockContext(txn, block); err != nil {
+			return err
+		}
+		utxo := UTXOSet{bc}
+		if err := utxo.connect(txn, block); err != nil {
+			return err
+		}
+		return errDryRun
 	})
-	HandleError(err)
-	return newBlock
+	if err == errDryRun {
+		return nil
+	}
+	return err
 }
 
-func NewBlockChain(address, nodeId string) *BlockChain {
-	var lastHash []byte
-	path := fmt.Sprintf(dbPath, nodeId)
+// NewBlockChain creates a chain whose genesis block pays address and is
+// sealed by engine, which every later block must also satisfy.
+func NewBlockChain(address, nodeId string, txIndex bool, engine Engine) *BlockChain {
+	path := fmt.Sprintf(Params.DBPath, nodeId)
 	if DBExists(path) {
 		fmt.Println("Blockchain already exists, loading from disk")
 		runtime.Goexit()
 	}
-	opts := badger.DefaultOptions(path)
-	// opts.Dir = dbPath
-	// opts.ValueDir = dbPath
-	db, err := openDB(path, opts)
+	cbtx := CoinbaseTx(address, genesisData, Params.Subsidy(0))
+	genesis := GenesisBlock(cbtx, engine)
+	fmt.Println("Genesis Block Created")
+	db, err := OpenBadger(path)
 	HandleError(err)
-	err = db.Update(func(txn *badger.Txn) error {
-		cbtx := CoinbaseTx(address, genesisData)
-		genesis := GenesisBlock(cbtx)
-		fmt.Println("Genesis Block Created")
-		fmt.Printf("Continuing blockchain at %s\n", path)
+	bc, err := createBlockChain(db, genesis, engine, txIndex)
+	HandleError(err)
+	fmt.Printf("Continuing blockchain at %s\n", path)
+	return bc
+}
+
+// CreateBlockChain creates a chain in db, which must be empty, like
+// NewBlockChain does on disk. The UTXO set is built as well, so the chain is
+// ready for use.
+func CreateBlockChain(db Storage, address string, txIndex bool, engine Engine) (*BlockChain, error) {
+	cbtx := CoinbaseTx(address, genesisData, Params.Subsidy(0))
+	genesis := GenesisBlock(cbtx, engine)
+	bc, err := createBlockChain(db, genesis, engine, txIndex)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(txn Txn) error {
+		utxo := UTXOSet{bc}
+		return utxo.connect(txn, genesis)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bc, nil
+}
+
+// createBlockChain stores genesis in db as the only block of a new chain.
+// The UTXO set is left empty.
+func createBlockChain(db Storage, genesis *Block, engine Engine, txIndex bool) (*BlockChain, error) {
+	err := db.Update(func(txn Txn) error {
 		err := txn.Set(genesis.Hash, genesis.Serialize())
 		HandleError(err)
-		err = txn.Set([]byte("lh"), genesis.Hash)
-		lastHash = genesis.Hash
-		return err
-
+		err = setChainWork(txn, genesis.Hash, engine.Work(genesis))
+		HandleError(err)
+		err = putEngine(txn, engine)
+		HandleError(err)
+		err = txn.Set(chainVersionKey, ToHex(ChainVersion))
+		HandleError(err)
+		if txIndex {
+			err = indexBlock(txn, genesis)
+			HandleError(err)
+			err = txn.Set(txIndexKey, []byte{1})
+			HandleError(err)
+		}
+		return txn.Set([]byte("lh"), genesis.Hash)
 	})
-	HandleError(err)
-	bc := BlockChain{lastHash, db}
-	return &bc
+	if err != nil {
+		return nil, err
+	}
+	bc := BlockChain{LastHash: genesis.Hash, Database: db, TxIndex: txIndex, Engine: engine}
+	return &bc, nil
 }
 
 func ContinueBlockChain(nodeId string) *BlockChain {
-	path := fmt.Sprintf(dbPath, nodeId)
+	path := fmt.Sprintf(Params.DBPath, nodeId)
 	
 	if !DBExists(path) {
 		fmt.Println("No existing blockchain found, create a new one")
 		runtime.Goexit()
 	}
-	var lastHash []byte
-	opts := badger.DefaultOptions(path)
-	db, err := openDB(path, opts)
+	db, err := OpenBadger(path)
 	HandleError(err)
-	err = db.Update(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		HandleError(err)
-			err = item.Value(func(val []byte) error {
-			lastHash = append([]byte{}, val...)
-			return nil
-		})
-		return err
-	})
+	bc, err := LoadBlockChain(db)
+	if errors.Is(err, ErrChainVersion) || errors.Is(err, ErrSnapshotHistory) {
+		db.Close()
+		fmt.Printf("Blockchain at %s: %v\n", path, err)
+		fmt.Println("Remove it and run createblockchain to start a new chain")
+		runtime.Goexit()
+	}
 	HandleError(err)
-	bc := BlockChain{lastHash, db}
-	return &bc
+	return bc
 }
 
-
-
-
-func (chain *BlockChain) FindUnspentTransactions(pubKeyHash []byte) []Transaction {
-	var unspentTxs []Transaction
-	spentTXOs := make(map[string][]int)
-
-	iter := chain.Iterator()
-	for {
-		block := iter.Next()
-		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
-
-			Outputs:
-			for outIdx, out := range tx.Outputs {
-				if spentTXOs[txID] != nil {
-					for _, spentOutIdx := range spentTXOs[txID] {
-						if spentOutIdx == outIdx {
-							continue Outputs
-						}
-					}
-				}
-				if out.IsLockedWithKey(pubKeyHash) {
-					unspentTxs = append(unspentTxs, *tx)
-					fmt.Printf("Found unspent transaction: %s\n", txID)
-				}
-			}
-
-			if !tx.IsCoinbase() {
-				for _, in := range tx.Inputs {
-					if in.UsesKey(pubKeyHash) {
-						inID := hex.EncodeToString(in.ID)
-						spentTXOs[inID] = append(spentTXOs[inID], in.OutIndex)
-					}
-				}
-			}
-
+// LoadBlockChain loads the chain stored in db. Chains stored in another
+// format than ChainVersion are rejected with ErrChainVersion, and chains
+// whose snapshot failed history validation with ErrSnapshotHistory.
+func LoadBlockChain(db Storage) (*BlockChain, error) {
+	var lastHash []byte
+	var version int64
+	var txIndex bool
+	var engine Engine
+	var pruneDepth int
+	var historyFailure []byte
+	err := db.View(func(txn Txn) error {
+		_, err := txn.Get(txIndexKey)
+		txIndex = err == nil
+		if engine, err = getEngine(txn); err != nil {
+			return err
 		}
-		if len(block.PrevHash) == 0 {
-			break
+		if pruneDepth, err = getPruneDepth(txn); err != nil {
+			return err
 		}
-	}
-	return unspentTxs
-}
-
-func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
-	UTXOs := make(map[string]TxOutputs) 
-	spentTxos := make(map[string][]int)
-	iter := chain.Iterator()
-	for {
-		block := iter.Next()
-		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
-
-			Outputs:
-			for outIdx, out := range tx.Outputs {
-				if spentTxos[txID] != nil {
-					for _, spentOutIdx := range spentTxos[txID] {
-						if spentOutIdx == outIdx {
-							continue Outputs
-						}
-					}
-				}
-				outs := UTXOs[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXOs[txID] = outs
+		if v, err := txn.Get(chainVersionKey); err == nil {
+			version = int64(binary.BigEndian.Uint64(v))
 		}
-			if !tx.IsCoinbase() {
-				for _, in := range tx.Inputs {
-						inID := hex.EncodeToString(in.ID)
-						spentTxos[inID] = append(spentTxos[inID], in.OutIndex)
-				}
-			}
-	}
-		if len(block.PrevHash) == 0 {
-			break
-		}
-	}	
-	return UTXOs
-}
-
-func (chain *BlockChain) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
-	unspentOutputs := make(map[string][]int)
-	unspentTxs := chain.FindUnspentTransactions(pubKeyHash)
-	accumulated := 0
-
-	Work:
-	for _, tx := range unspentTxs {
-		txID := hex.EncodeToString(tx.ID)
-		for outIdx, out := range tx.Outputs {
-			if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-				accumulated += out.Value
-				unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
-			}
-			if accumulated >= amount {
-				break Work
-			}
+		if v, err := txn.Get(historyFailedKey); err == nil {
+			historyFailure = v
 		}
+		lastHash, err = txn.Get([]byte("lh"))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if version != ChainVersion {
+		return nil, fmt.Errorf("%w: storage format %d, this node needs %d", ErrChainVersion, version, ChainVersion)
 	}
-	return accumulated, unspentOutputs
+	if historyFailure != nil {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotHistory, historyFailure)
+	}
+	bc := BlockChain{LastHash: lastHash, Database: db, TxIndex: txIndex, Engine: engine, PruneDepth: pruneDepth}
+	return &bc, nil
 }
 
-func (chain *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
+// FindTransactionBlock returns the block on the current chain that contains
+// the transaction with the given ID.
+func (chain *BlockChain) FindTransactionBlock(ID []byte) (*Block, error) {
+	if chain.TxIndex {
+		_, block, err := chain.GetTransaction(ID)
+		return block, err
+	}
 	iter := chain.Iterator()
 	for {
 		block := iter.Next()
 		for _, tx := range block.Transactions {
 			if bytes.Equal(tx.ID, ID) {
-				return *tx, nil
+				return block, nil
 			}
 		}
 		if len(block.PrevHash) == 0 {
 			break
 		}
 	}
-	return Transaction{}, errors.New("transaction not found")
-
+	return nil, errors.New("transaction not found")
 }
 
 func (chain *BlockChain) SignTransaction(tx *Transaction, privateKey ecdsa.PrivateKey) {
-	prevTXs := make(map[string]Transaction)
-	for _, in := range tx.Inputs {
-		prevTX, err := chain.FindTransaction(in.ID)
-		HandleError(err)
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
-	}
+	prevTXs, err := chain.previousTransactions(tx)
+	HandleError(err)
 	tx.Sign(privateKey, prevTXs)
 }
 
+func (chain *BlockChain) SignMultisigTransaction(tx *Transaction, privateKeys []ecdsa.PrivateKey, redeemScript []byte) {
+	prevTXs, err := chain.previousTransactions(tx)
+	HandleError(err)
+	tx.SignMultisig(privateKeys, redeemScript, prevTXs)
+}
+
+// previousTransactions returns the transactions whose outputs tx spends,
+// rebuilt from the UTXO set so that it works on pruned chains. Only the
+// spent outputs are filled in.
+func (chain *BlockChain) previousTransactions(tx *Transaction) (map[string]Transaction, error) {
+	prevTXs := make(map[string]Transaction)
+	err := chain.Database.View(func(txn Txn) error {
+		for _, in := range tx.Inputs {
+			outs, err := getOutputs(txn, prefixedKey(utxoPrefix, in.ID))
+			if err == ErrKeyNotFound {
+				return ErrMissingInput
+			}
+			if err != nil {
+				return err
+			}
+			out, ok := outs.Get(in.OutIndex)
+			if !ok {
+				return ErrMissingInput
+			}
+			prevTX := prevTXs[hex.EncodeToString(in.ID)]
+			prevTX.ID = in.ID
+			for len(prevTX.Outputs) <= in.OutIndex {
+				prevTX.Outputs = append(prevTX.Outputs, TxOutput{})
+			}
+			prevTX.Outputs[in.OutIndex] = out
+			prevTXs[hex.EncodeToString(in.ID)] = prevTX
+		}
+		return nil
+	})
+	return prevTXs, err
+}
+
+// IsFinalTx reports whether tx may go into the next block.
+func (chain *BlockChain) IsFinalTx(tx *Transaction) bool {
+	return tx.IsFinal(chain.GetBestHeight()+1, chain.MedianTimePast())
+}
+
 func (chain *BlockChain) VerifyTransaction(tx *Transaction) bool {
 	
 	if tx.IsCoinbase() {
 		return true
 	}
 
-	prevTXs := make(map[string]Transaction)
-	for _, in := range tx.Inputs {
-		prevTX, err := chain.FindTransaction(in.ID)
-		HandleError(err)
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	utxo := UTXOSet{chain}
+	if utxo.spendsImmatureCoinbase(tx, chain.GetBestHeight()+1) {
+		return false
+	}
+	prevTXs, err := chain.previousTransactions(tx)
+	if err != nil {
+		return false
 	}
-
 	return tx.Verify(prevTXs)
 }
 
-func retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
-	lockPath := filepath.Join(dir, "LOCK")
-	if err := os.Remove(lockPath); err != nil {
-		return nil, fmt.Errorf(`removing "LOCK": %s`, err)
+// DeleteByPrefix removes every key starting with prefix, in batches.
+func (bc *BlockChain) DeleteByPrefix(prefix []byte) {
+	deleteKeys := func(keysForDelete [][]byte) error {
+		if err := bc.Database.Update(func(txn Txn) error {
+			for _, key := range keysForDelete {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		return nil
 	}
-	retryOpts := originalOpts
-	retryOpts.Truncate = true
-	db, err := badger.Open(retryOpts)
-	return db, err
-}
 
-func openDB(dir string, opts badger.Options) (*badger.DB, error) {
-	if db, err := badger.Open(opts); err != nil {
-		if strings.Contains(err.Error(), "LOCK") {
-			if db, err := retry(dir, opts); err == nil {
-				log.Println("database unlocked, value log truncated")
-				return db, nil
-			}
-			log.Println("could not unlock database:", err)
+	var keys [][]byte
+	err := bc.Database.View(func(txn Txn) error {
+		return txn.Scan(prefix, func(key, _ []byte) error {
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	collectSize := 100000
+	for len(keys) > 0 {
+		n := min(collectSize, len(keys))
+		if err := deleteKeys(keys[:n]); err != nil {
+			log.Panic(err)
 		}
-		return nil, err
-	} else {
-		return db, nil
+		keys = keys[n:]
 	}
-}
\ No newline at end of file
+}
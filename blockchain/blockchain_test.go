@@ -0,0 +1,102 @@
+package blockchain
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/nthskyradiated/go-bc/wallet"
+)
+
+func TestMain(m *testing.M) {
+	// Regtest blocks are mined at the minimum difficulty, so every test
+	// chain is mined instantly.
+	if err := SelectNetwork("regtest"); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestChain creates a proof-of-work chain in memory whose genesis block
+// pays the returned wallet.
+func newTestChain(t *testing.T) (*BlockChain, *wallet.Wallet) {
+	t.Helper()
+	w := wallet.MakeWallet()
+	chain, err := CreateBlockChain(NewMemoryStorage(), string(w.Address()), true, PoWEngine{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain, w
+}
+
+// mineTxs mines a block with txs on the tip of chain, its coinbase paying
+// the subsidy and the fees to miner.
+func mineTxs(t *testing.T, chain *BlockChain, miner string, txs ...*Transaction) *Block {
+	t.Helper()
+	block, err := tryMine(chain, miner, txs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func tryMine(chain *BlockChain, miner string, txs ...*Transaction) (*Block, error) {
+	utxo := UTXOSet{chain}
+	reward := Params.Subsidy(chain.GetBestHeight() + 1)
+	for _, tx := range txs {
+		fee, err := utxo.Fee(tx)
+		if err != nil {
+			return nil, err
+		}
+		reward += fee
+	}
+	return chain.MineBlock(context.Background(), append([]*Transaction{CoinbaseTx(miner, "", reward)}, txs...))
+}
+
+// forkBlock seals a block with txs on parent without adding it to a chain.
+func forkBlock(t *testing.T, parent *Block, txs ...*Transaction) *Block {
+	t.Helper()
+	return NewBlock(txs, parent.Hash, parent.Height+1, parent.Difficulty, parent.Timestamp+1, PoWEngine{})
+}
+
+func tip(t *testing.T, chain *BlockChain) *Block {
+	t.Helper()
+	block, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &block
+}
+
+func balance(chain *BlockChain, w *wallet.Wallet) int {
+	spendable, immature := UTXOSet{chain}.Balance(wallet.PublicKeyHash(w.PublicKey))
+	return spendable + immature
+}
+
+// dumpKeys returns every key starting with prefix and its value.
+func dumpKeys(t *testing.T, chain *BlockChain, prefix []byte) map[string]string {
+	t.Helper()
+	keys := make(map[string]string)
+	err := chain.Database.View(func(txn Txn) error {
+		return txn.Scan(prefix, func(k, v []byte) error {
+			keys[string(k)] = string(v)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func sameKeys(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,191 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A bootstrap file holds the main chain for seeding nodes offline:
+//
+//	magic   8 bytes, "gobcblks"
+//	engine  bytes, the authority keys of a proof-of-authority chain
+//	blocks  each block from the genesis block up as bytes, until the end
+//	          of the file
+//
+// in the encoding of encoding.go.
+const bootstrapMagic = "gobcblks"
+
+// progressInterval is how many blocks are exported or imported between
+// progress reports.
+const progressInterval = 100
+
+var ErrBootstrapGenesis = errors.New("bootstrap file starts from a different genesis block")
+
+// ExportBlocks writes the blocks of the main chain to a bootstrap file at
+// path, in height order, and returns how many it wrote. Pruned chains
+// cannot be exported.
+func (bc *BlockChain) ExportBlocks(path string) (int, error) {
+	hashes := bc.GetBlockHashes()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	w.WriteString(bootstrapMagic)
+	w.Write(appendBytes(nil, encodeEngine(bc.Engine)))
+
+	for i := len(hashes) - 1; i >= 0; i-- {
+		block, err := bc.GetBlock(hashes[i])
+		if err != nil {
+			return 0, err
+		}
+		if block.Pruned() {
+			return 0, fmt.Errorf("cannot export block %d: %w", block.Height, ErrPruned)
+		}
+		if _, err := w.Write(appendBytes(nil, block.Serialize())); err != nil {
+			return 0, err
+		}
+		if exported := len(hashes) - i; exported%progressInterval == 0 {
+			fmt.Printf("Exported %d of %d blocks\n", exported, len(hashes))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	return len(hashes), nil
+}
+
+// ImportBlocks adds the blocks of the bootstrap file at path to the chain of
+// node nodeId, creating the chain from the file's genesis block if the node
+// has none. Every block is fully validated by AddBlock. It returns the chain
+// and the number of blocks added; blocks already stored are skipped.
+func ImportBlocks(path, nodeId string) (*BlockChain, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	counter := &countingReader{r: f}
+	r := bufio.NewReader(counter)
+
+	magic := make([]byte, len(bootstrapMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != bootstrapMagic {
+		return nil, 0, ErrMalformedEncoding
+	}
+	engineData, err := readRecord(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	engine, err := decodeEngine(engineData)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := readRecord(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	genesis, err := DecodeBlock(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var chain *BlockChain
+	dbDir := fmt.Sprintf(Params.DBPath, nodeId)
+	if DBExists(dbDir) {
+		chain = ContinueBlockChain(nodeId)
+		if !bytes.Equal(encodeEngine(chain.Engine), engineData) {
+			chain.Database.Close()
+			return nil, 0, errors.New("bootstrap file uses a different consensus engine")
+		}
+		if _, err := chain.GetBlock(genesis.Hash); err != nil {
+			chain.Database.Close()
+			return nil, 0, ErrBootstrapGenesis
+		}
+	} else {
+		if len(genesis.PrevHash) != 0 || genesis.Height != 0 {
+			return nil, 0, ErrBootstrapGenesis
+		}
+		if err := CheckBlock(engine, genesis); err != nil {
+			return nil, 0, err
+		}
+		db, err := OpenBadger(dbDir)
+		if err != nil {
+			return nil, 0, err
+		}
+		if chain, err = createBlockChain(db, genesis, engine, true); err != nil {
+			db.Close()
+			return nil, 0, err
+		}
+		utxo := UTXOSet{chain}
+		utxo.Update(genesis)
+	}
+
+	added := 0
+	for read := 1; ; read++ {
+		data, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		var block *Block
+		if err == nil {
+			block, err = DecodeBlock(data)
+		}
+		if err != nil {
+			return chain, added, fmt.Errorf("block %d of the file: %w", read, err)
+		}
+		if _, err := chain.GetBlock(block.Hash); err != nil {
+			if err := chain.AddBlock(block); err != nil {
+				return chain, added, fmt.Errorf("block %d of the file: %w", read, err)
+			}
+			added++
+		}
+		if read%progressInterval == 0 {
+			fmt.Printf("Imported %d blocks, %d%% of the file\n", read, counter.n*100/max(info.Size(), 1))
+		}
+	}
+	return chain, added, nil
+}
+
+// readRecord reads one length-prefixed record. It returns io.EOF only at the
+// end of the input, before a record starts.
+func readRecord(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrMalformedEncoding
+		}
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if int64(n) > int64(Params.MaxBlockSize) {
+		return nil, ErrMalformedEncoding
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, ErrMalformedEncoding
+	}
+	return data, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,194 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// engineKey stores the authority keys of a proof-of-authority chain. Chains
+// without it use proof-of-work.
+var engineKey = []byte("engine")
+
+var (
+	ErrNotInTurn    = errors.New("no key of the authority in turn is available")
+	ErrBadAuthority = errors.New("authority is not a valid public key")
+)
+
+// Engine decides who may add a block and how that is proven.
+type Engine interface {
+	// Seal completes block, whose header fields other than the nonce are
+	// final, and sets its hash. It returns ctx's error if ctx is cancelled
+	// first.
+	Seal(ctx context.Context, block *Block) error
+	// VerifySeal checks the proof carried by a sealed block. It returns one
+	// of the Err* values of validation.go.
+	VerifySeal(block *Block) error
+	// Work is the weight block adds to its chain for fork choice.
+	Work(block *Block) *big.Int
+}
+
+// PoWEngine seals blocks by searching for a nonce that meets the block's
+// difficulty, using MiningWorkers goroutines.
+type PoWEngine struct{}
+
+func (PoWEngine) Seal(ctx context.Context, block *Block) error {
+	return block.Mine(ctx, MiningWorkers)
+}
+
+func (PoWEngine) VerifySeal(block *Block) error {
+	if len(block.Signature) != 0 {
+		return ErrBadSeal
+	}
+	if !NewProofOfWork(block).Validate() {
+		return ErrProofOfWork
+	}
+	return nil
+}
+
+func (PoWEngine) Work(block *Block) *big.Int {
+	return NewProofOfWork(block).Work()
+}
+
+// PoAEngine seals blocks with a signature of one of a fixed set of
+// authorities. The authorities take turns: the block at height h must be
+// signed by Authorities[h % len(Authorities)].
+type PoAEngine struct {
+	// Authorities are the public keys, in the encoding wallets use, that may
+	// sign blocks.
+	Authorities [][]byte
+	signers     map[string]*ecdsa.PrivateKey
+}
+
+func NewPoAEngine(authorities [][]byte) (*PoAEngine, error) {
+	if len(authorities) == 0 {
+		return nil, fmt.Errorf("%w: no authorities given", ErrBadAuthority)
+	}
+	for _, authority := range authorities {
+		if x, _ := elliptic.Unmarshal(elliptic.P256(), authority); x == nil {
+			return nil, fmt.Errorf("%w: %x", ErrBadAuthority, authority)
+		}
+	}
+	return &PoAEngine{Authorities: authorities, signers: make(map[string]*ecdsa.PrivateKey)}, nil
+}
+
+// AddSigner lets the engine seal blocks on behalf of the authority owning
+// key. It reports whether key belongs to an authority.
+func (e *PoAEngine) AddSigner(key ecdsa.PrivateKey) bool {
+	pubKey := elliptic.Marshal(key.Curve, key.X, key.Y)
+	for _, authority := range e.Authorities {
+		if bytes.Equal(authority, pubKey) {
+			e.signers[hex.EncodeToString(pubKey)] = &key
+			return true
+		}
+	}
+	return false
+}
+
+// AddSigners calls AddSigner for each of keys if engine is a *PoAEngine and
+// returns how many belong to an authority. Other engines need no keys.
+func AddSigners(engine Engine, keys []ecdsa.PrivateKey) int {
+	poa, ok := engine.(*PoAEngine)
+	if !ok {
+		return 0
+	}
+	added := 0
+	for _, key := range keys {
+		if poa.AddSigner(key) {
+			added++
+		}
+	}
+	return added
+}
+
+// Authority returns the public key that must sign the block at height.
+func (e *PoAEngine) Authority(height int) []byte {
+	return e.Authorities[height%len(e.Authorities)]
+}
+
+func (e *PoAEngine) Seal(ctx context.Context, block *Block) error {
+	authority := e.Authority(block.Height)
+	key, ok := e.signers[hex.EncodeToString(authority)]
+	if !ok {
+		return fmt.Errorf("%w: block %d belongs to %x", ErrNotInTurn, block.Height, authority)
+	}
+	block.Nonce = 0
+	hash := block.BlockHeader.Hash()
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash)
+	if err != nil {
+		return err
+	}
+	block.Hash = hash
+	block.Signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return nil
+}
+
+func (e *PoAEngine) VerifySeal(block *Block) error {
+	if !checkSignature(block.BlockHeader.Hash(), block.Signature, e.Authority(block.Height)) {
+		return ErrBadSeal
+	}
+	return nil
+}
+
+// Work counts every block the same, so the longest chain wins.
+func (e *PoAEngine) Work(block *Block) *big.Int {
+	return big.NewInt(1)
+}
+
+// putEngine records engine in the database so every later run of the node
+// validates with it.
+func putEngine(txn Txn, engine Engine) error {
+	data := encodeEngine(engine)
+	if data == nil {
+		return nil
+	}
+	return txn.Set(engineKey, data)
+}
+
+// encodeEngine returns the authority keys of a *PoAEngine, or nil for
+// proof-of-work.
+func encodeEngine(engine Engine) []byte {
+	poa, ok := engine.(*PoAEngine)
+	if !ok {
+		return nil
+	}
+	data := appendUint32(nil, uint32(len(poa.Authorities)))
+	for _, authority := range poa.Authorities {
+		data = appendBytes(data, authority)
+	}
+	return data
+}
+
+func getEngine(txn Txn) (Engine, error) {
+	data, err := txn.Get(engineKey)
+	if err == ErrKeyNotFound {
+		return PoWEngine{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeEngine(data)
+}
+
+// decodeEngine reverses encodeEngine.
+func decodeEngine(data []byte) (Engine, error) {
+	if len(data) == 0 {
+		return PoWEngine{}, nil
+	}
+	r := &reader{data: data}
+	var authorities [][]byte
+	count := r.count(4)
+	for i := 0; i < count; i++ {
+		authorities = append(authorities, r.bytes())
+	}
+	if err := r.finish(); err != nil {
+		return nil, err
+	}
+	return NewPoAEngine(authorities)
+}
@@ -0,0 +1,113 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Blocks, transactions and outputs have a fixed binary encoding, so that
+// their hashes do not depend on the Go version and other clients can produce
+// them. Integers are big-endian and fixed width; byte strings and lists are
+// prefixed with their length as a uint32.
+//
+// transaction:
+//
+//	version    uint32, TxVersion
+//	inputs     uint32 count, then per input:
+//	             txid bytes, output index int32 (-1 in a coinbase),
+//	             unlocking script bytes, sequence uint32
+//	outputs    uint32 count, then per output:
+//	             value int64, locking script bytes
+//	lock time  uint32
+//
+// block:
+//
+//	header        92 bytes, see BlockHeader.Serialize
+//	signature     bytes, empty unless the chain uses proof-of-authority
+//	transactions  uint32 count, then each transaction as bytes
+//
+// Neither encoding includes the hash identifying it; a transaction ID is the
+// SHA-256 of its encoding and a block hash that of its header, so the hash
+// does not cover the signature.
+
+// TxVersion is the transaction encoding version produced by this node.
+const TxVersion = 1
+
+var ErrMalformedEncoding = errors.New("malformed encoding")
+
+func appendUint32(b []byte, v uint32) []byte {
+	return binary.BigEndian.AppendUint32(b, v)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return binary.BigEndian.AppendUint64(b, v)
+}
+
+func appendBytes(b, data []byte) []byte {
+	b = appendUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
+// reader decodes the fields of an encoding in order. The first error is kept
+// and every read after it returns zero values.
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = ErrMalformedEncoding
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *reader) uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *reader) bytes() []byte {
+	n := int(r.uint32())
+	b := r.next(n)
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// count reads a list length, rejecting lengths the remaining data cannot
+// hold at minSize bytes per item.
+func (r *reader) count(minSize int) int {
+	n := int(r.uint32())
+	if r.err == nil && n*minSize > len(r.data) {
+		r.err = ErrMalformedEncoding
+		return 0
+	}
+	return n
+}
+
+// finish returns the decoding error, treating unread data as one.
+func (r *reader) finish() error {
+	if r.err == nil && len(r.data) > 0 {
+		r.err = ErrMalformedEncoding
+	}
+	return r.err
+}
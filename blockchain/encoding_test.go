@@ -0,0 +1,107 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/nthskyradiated/go-bc/wallet"
+)
+
+func TestHeaderSize(t *testing.T) {
+	header := BlockHeader{Version: BlockVersion, PrevHash: make([]byte, 32), Difficulty: 12, Nonce: 7, Height: 3}
+	data := header.Serialize()
+	if len(data) != 92 {
+		t.Fatalf("header is %d bytes, want 92", len(data))
+	}
+	if nonce := data[nonceOffset : nonceOffset+4]; !bytes.Equal(nonce, []byte{0, 0, 0, 7}) {
+		t.Errorf("nonce at offset %d is %x", nonceOffset, nonce)
+	}
+	if got := DeserializeHeader(data); !bytes.Equal(got.Hash(), header.Hash()) {
+		t.Error("the header changed in a round trip")
+	}
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	chain, alice := newTestChain(t)
+	utxo := UTXOSet{chain}
+	tx := NewTransaction(alice, string(wallet.MakeWallet().Address()), 5, 1, 0, &utxo)
+	block := mineTxs(t, chain, string(alice.Address()), tx)
+
+	decoded, err := DecodeBlock(block.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Hash, block.Hash) {
+		t.Errorf("decoded block hash is %x, want %x", decoded.Hash, block.Hash)
+	}
+	if !bytes.Equal(decoded.Serialize(), block.Serialize()) {
+		t.Error("the block encodes differently after a round trip")
+	}
+	if len(decoded.Transactions) != 2 || !bytes.Equal(decoded.Transactions[1].ID, tx.ID) {
+		t.Fatal("the decoded block has other transactions")
+	}
+
+	decodedTx, err := DecodeTransaction(tx.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decodedTx.ID, tx.ID) || decodedTx.String() != tx.String() {
+		t.Error("the transaction changed in a round trip")
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	chain, alice := newTestChain(t)
+	block := mineTxs(t, chain, string(alice.Address()))
+	data := block.Serialize()
+	txData := block.Transactions[0].Serialize()
+
+	blocks := map[string][]byte{
+		"empty":            nil,
+		"truncated header": data[:50],
+		"truncated body":   data[:len(data)-1],
+		"trailing data":    append(append([]byte{}, data...), 0),
+		"huge count":       append(append([]byte{}, data[:92+4]...), 0xff, 0xff, 0xff, 0xff),
+	}
+	for name, data := range blocks {
+		if _, err := DecodeBlock(data); err == nil {
+			t.Errorf("DecodeBlock(%s) succeeded", name)
+		}
+	}
+
+	badVersion := append([]byte{}, txData...)
+	badVersion[3]++
+	txs := map[string][]byte{
+		"empty":         nil,
+		"truncated":     txData[:len(txData)-1],
+		"trailing data": append(append([]byte{}, txData...), 0),
+		"bad version":   badVersion,
+	}
+	for name, data := range txs {
+		if _, err := DecodeTransaction(data); err == nil {
+			t.Errorf("DecodeTransaction(%s) succeeded", name)
+		}
+	}
+	if _, err := DecodeTransaction(txData[:2]); !errors.Is(err, ErrMalformedEncoding) {
+		t.Errorf("DecodeTransaction of 2 bytes = %v, want %v", err, ErrMalformedEncoding)
+	}
+}
+
+func TestOutputsRoundTrip(t *testing.T) {
+	outs := TxOutputs{Height: 5, Coinbase: true}
+	outs.Add(0, *NewTXOutput(3, string(wallet.MakeWallet().Address())))
+	outs.Add(2, *NewTXOutput(4, string(wallet.MakeWallet().Address())))
+	outs.Remove(0)
+
+	decoded := DeserializeOutputs(outs.Serialize())
+	if decoded.Height != 5 || !decoded.Coinbase {
+		t.Errorf("decoded height %d, coinbase %v", decoded.Height, decoded.Coinbase)
+	}
+	if _, ok := decoded.Get(0); ok {
+		t.Error("a removed output is present after a round trip")
+	}
+	if out, ok := decoded.Get(2); !ok || out.Value != 4 {
+		t.Errorf("output 2 is %v, %v after a round trip", out, ok)
+	}
+}
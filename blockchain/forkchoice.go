@@ -0,0 +1,214 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var workPrefix = []byte("work-")
+
+// reorganize moves the tip from oldTipHash to newTip. Blocks on the old
+// branch are disconnected from the UTXO set down to the fork point, then the
+// blocks of the new branch are connected on top of it.
+func (bc *BlockChain) reorganize(txn Txn, oldTipHash []byte, newTip *Block) error {
+	oldTip, err := getBlock(txn, oldTipHash)
+	if err != nil {
+		return err
+	}
+
+	var disconnect, connect []*Block
+	oldBranch, newBranch := oldTip, newTip
+	for oldBranch.Height > newBranch.Height {
+		disconnect = append(disconnect, oldBranch)
+		if oldBranch, err = getBlock(txn, oldBranch.PrevHash); err != nil {
+			return err
+		}
+	}
+	for newBranch.Height > oldBranch.Height {
+		connect = append(connect, newBranch)
+		if newBranch, err = getBlock(txn, newBranch.PrevHash); err != nil {
+			return err
+		}
+	}
+	for !bytes.Equal(oldBranch.Hash, newBranch.Hash) {
+		if len(oldBranch.PrevHash) == 0 || len(newBranch.PrevHash) == 0 {
+			return errors.New("branches do not share a genesis block")
+		}
+		disconnect = append(disconnect, oldBranch)
+		connect = append(connect, newBranch)
+		if oldBranch, err = getBlock(txn, oldBranch.PrevHash); err != nil {
+			return err
+		}
+		if newBranch, err = getBlock(txn, newBranch.PrevHash); err != nil {
+			return err
+		}
+	}
+
+	// A branch through a block marked invalid stays invalid, however much
+	// work is added on top of it.
+	for _, block := range connect {
+		if _, err := txn.Get(prefixedKey(invalidPrefix, block.Hash)); err == nil {
+			return blockError(newTip, ErrInvalidParent)
+		} else if err != ErrKeyNotFound {
+			return err
+		}
+	}
+
+	for _, block := range disconnect {
+		if err := bc.disconnectBlock(txn, block); err != nil {
+			return err
+		}
+	}
+	for i := len(connect) - 1; i >= 0; i-- {
+		if err := bc.connectBlock(txn, connect[i]); err != nil {
+			return err
+		}
+	}
+
+	if len(disconnect) > 0 {
+		fmt.Printf("Reorganized chain at height %d: %d block(s) disconnected, %d connected\n",
+			oldBranch.Height, len(disconnect), len(connect))
+	}
+	return txn.Set([]byte("lh"), newTip.Hash)
+}
+
+// connectBlock applies block to the UTXO set and the transaction index.
+func (bc *BlockChain) connectBlock(txn Txn, block *Block) error {
+	utxo := UTXOSet{bc}
+	if err := utxo.connect(txn, block); err != nil {
+		return err
+	}
+	if bc.TxIndex {
+		return indexBlock(txn, block)
+	}
+	return nil
+}
+
+// disconnectBlock reverts connectBlock.
+func (bc *BlockChain) disconnectBlock(txn Txn, block *Block) error {
+	if block.Pruned() {
+		return fmt.Errorf("cannot disconnect block %x: %w", block.Hash, ErrPruned)
+	}
+	utxo := UTXOSet{bc}
+	if err := utxo.disconnect(txn, block); err != nil {
+		return err
+	}
+	if bc.TxIndex {
+		return unindexBlock(txn, block)
+	}
+	return nil
+}
+
+// disconnectTip disconnects the block at the tip and makes its parent the
+// new tip. It returns the disconnected block.
+func (bc *BlockChain) disconnectTip() (*Block, error) {
+	var tip *Block
+	err := bc.Database.Update(func(txn Txn) error {
+		lastHash, err := getLastHash(txn)
+		if err != nil {
+			return err
+		}
+		if tip, err = getBlock(txn, lastHash); err != nil {
+			return err
+		}
+		if len(tip.PrevHash) == 0 {
+			return errors.New("cannot disconnect the genesis block")
+		}
+		if err := bc.disconnectBlock(txn, tip); err != nil {
+			return err
+		}
+		return txn.Set([]byte("lh"), tip.PrevHash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	bc.LastHash = tip.PrevHash
+	return tip, nil
+}
+
+// RollbackTo disconnects blocks from the tip until the tip is at height.
+func (bc *BlockChain) RollbackTo(height int) error {
+	best := bc.GetBestHeight()
+	if height < 0 || height > best {
+		return fmt.Errorf("height %d is outside the chain (best height %d)", height, best)
+	}
+	if pruned := bc.PrunedHeight(); height < pruned {
+		return fmt.Errorf("cannot roll back below height %d: %w", pruned, ErrPruned)
+	}
+	for ; best > height; best-- {
+		if _, err := bc.disconnectTip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InvalidateBlock marks a block of the main chain as invalid and
+// disconnects it together with every block built on it.
+func (bc *BlockChain) InvalidateBlock(hash []byte) error {
+	block, err := bc.GetBlock(hash)
+	if err != nil {
+		return err
+	}
+	if len(block.PrevHash) == 0 {
+		return errors.New("cannot invalidate the genesis block")
+	}
+	if block.Pruned() {
+		return fmt.Errorf("cannot invalidate block %x: %w", hash, ErrPruned)
+	}
+	iter := bc.Iterator()
+	for {
+		ancestor := iter.Next()
+		if ancestor.Height <= block.Height {
+			if !bytes.Equal(ancestor.Hash, hash) {
+				return errors.New("block is not on the main chain")
+			}
+			break
+		}
+	}
+
+	for {
+		tip, err := bc.disconnectTip()
+		if err != nil {
+			return err
+		}
+		if err := bc.markInvalid(tip.Hash); err != nil {
+			return err
+		}
+		if bytes.Equal(tip.Hash, hash) {
+			return nil
+		}
+	}
+}
+
+// getChainWork returns the total work of the chain ending at hash, which is
+// stored with every block.
+func getChainWork(txn Txn, hash []byte) (*big.Int, error) {
+	v, err := txn.Get(prefixedKey(workPrefix, hash))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(v), nil
+}
+
+func setChainWork(txn Txn, hash []byte, work *big.Int) error {
+	return txn.Set(prefixedKey(workPrefix, hash), work.Bytes())
+}
+
+func getLastHash(txn Txn) ([]byte, error) {
+	return txn.Get([]byte("lh"))
+}
+
+func getBlock(txn Txn, hash []byte) (*Block, error) {
+	v, err := txn.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	return Deserialize(v), nil
+}
+
+func prefixedKey(prefix, key []byte) []byte {
+	return append(append([]byte{}, prefix...), key...)
+}
@@ -0,0 +1,136 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nthskyradiated/go-bc/wallet"
+)
+
+func TestReorganizeOntoHeavierBranch(t *testing.T) {
+	chain, alice := newTestChain(t)
+	bob := wallet.MakeWallet()
+	genesis := tip(t, chain)
+	utxo := UTXOSet{chain}
+
+	pay := NewTransaction(alice, string(bob.Address()), 5, 1, 0, &utxo)
+	a1 := mineTxs(t, chain, string(alice.Address()), pay)
+	if got := balance(chain, bob); got != 5 {
+		t.Fatalf("bob has %d before the reorg, want 5", got)
+	}
+
+	carol := wallet.MakeWallet()
+	b1 := forkBlock(t, genesis, CoinbaseTx(string(carol.Address()), "", Params.Subsidy(1)))
+	if err := chain.AddBlock(b1); err != nil {
+		t.Fatal(err)
+	}
+	if string(chain.LastHash) != string(a1.Hash) {
+		t.Fatal("a branch of equal work replaced the tip")
+	}
+	b2 := forkBlock(t, b1, CoinbaseTx(string(carol.Address()), "", Params.Subsidy(2)))
+	if err := chain.AddBlock(b2); err != nil {
+		t.Fatal(err)
+	}
+	if string(chain.LastHash) != string(b2.Hash) {
+		t.Fatal("the heavier branch did not become the tip")
+	}
+
+	if got := balance(chain, bob); got != 0 {
+		t.Errorf("bob has %d after the reorg, want 0", got)
+	}
+	if got, want := balance(chain, alice), Params.Subsidy(0); got != want {
+		t.Errorf("alice has %d after the reorg, want %d", got, want)
+	}
+	if got, want := balance(chain, carol), Params.Subsidy(1)+Params.Subsidy(2); got != want {
+		t.Errorf("carol has %d after the reorg, want %d", got, want)
+	}
+	if _, _, err := chain.GetTransaction(pay.ID); err == nil {
+		t.Error("a transaction of the old branch is still indexed")
+	}
+
+	incremental := dumpKeys(t, chain, utxoPrefix)
+	utxo.Reindex()
+	if !sameKeys(incremental, dumpKeys(t, chain, utxoPrefix)) {
+		t.Error("the UTXO set after the reorg differs from a reindex")
+	}
+}
+
+func TestReorganizeRejectsInvalidBranch(t *testing.T) {
+	chain, alice := newTestChain(t)
+	genesis := tip(t, chain)
+	a1 := mineTxs(t, chain, string(alice.Address()))
+
+	b1 := forkBlock(t, genesis, CoinbaseTx(string(alice.Address()), "", Params.Subsidy(1)))
+	if err := chain.AddBlock(b1); err != nil {
+		t.Fatal(err)
+	}
+	// The coinbase of b2 claims more than the subsidy, which is only found
+	// when b2 is connected.
+	b2 := forkBlock(t, b1, CoinbaseTx(string(alice.Address()), "", Params.Subsidy(2)+1))
+	if err := chain.AddBlock(b2); !errors.Is(err, ErrBadReward) {
+		t.Fatalf("AddBlock = %v, want %v", err, ErrBadReward)
+	}
+	if string(chain.LastHash) != string(a1.Hash) {
+		t.Error("the tip moved to an invalid branch")
+	}
+}
+
+func TestRollbackRestoresSpentOutputs(t *testing.T) {
+	chain, alice := newTestChain(t)
+	bob := wallet.MakeWallet()
+	utxo := UTXOSet{chain}
+	before := dumpKeys(t, chain, utxoPrefix)
+	beforeIndex := dumpKeys(t, chain, addrUTXOPrefix)
+
+	mineTxs(t, chain, string(bob.Address()), NewTransaction(alice, string(bob.Address()), 3, 1, 0, &utxo))
+	mineTxs(t, chain, string(bob.Address()), NewTransaction(alice, string(bob.Address()), 4, 0, 0, &utxo))
+	if got, want := balance(chain, alice), Params.Subsidy(0)-8; got != want {
+		t.Fatalf("alice has %d, want %d", got, want)
+	}
+
+	if err := chain.RollbackTo(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := chain.GetBestHeight(); got != 0 {
+		t.Fatalf("best height is %d after the rollback, want 0", got)
+	}
+	if !sameKeys(before, dumpKeys(t, chain, utxoPrefix)) {
+		t.Error("the UTXO set differs from the one before the blocks")
+	}
+	if !sameKeys(beforeIndex, dumpKeys(t, chain, addrUTXOPrefix)) {
+		t.Error("the address index differs from the one before the blocks")
+	}
+	if undo := dumpKeys(t, chain, undoPrefix); len(undo) != 1 {
+		t.Errorf("%d undo records left, want only the genesis block's", len(undo))
+	}
+	if err := chain.RollbackTo(1); err == nil {
+		t.Error("rolled back to a height above the tip")
+	}
+}
+
+// An invalidated block must not come back as the ancestor of a side branch
+// that gains more work.
+func TestReorganizeSkipsInvalidatedBlocks(t *testing.T) {
+	chain, alice := newTestChain(t)
+	genesis := tip(t, chain)
+	x := mineTxs(t, chain, string(alice.Address()))
+	mineTxs(t, chain, string(alice.Address()))
+	side := forkBlock(t, x, CoinbaseTx(string(alice.Address()), "", Params.Subsidy(2)))
+	if err := chain.AddBlock(side); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := chain.InvalidateBlock(x.Hash); err != nil {
+		t.Fatal(err)
+	}
+	if string(chain.LastHash) != string(genesis.Hash) {
+		t.Fatal("invalidating the first block did not move the tip to the genesis block")
+	}
+	next := forkBlock(t, side, CoinbaseTx(string(alice.Address()), "", Params.Subsidy(3)))
+	if err := chain.AddBlock(next); !errors.Is(err, ErrInvalidParent) {
+		t.Errorf("AddBlock on a branch through the invalidated block = %v, want %v", err, ErrInvalidParent)
+	}
+	if string(chain.LastHash) != string(genesis.Hash) {
+		t.Errorf("the tip moved to height %d", chain.GetBestHeight())
+	}
+}
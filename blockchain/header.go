@@ -0,0 +1,88 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// BlockVersion is the header version produced by this node.
+const BlockVersion = 1
+
+// BlockHeader holds every field the block hash commits to. The hash is the
+// SHA-256 of Serialize, so changing any of them invalidates the block.
+type BlockHeader struct {
+	Version    int32
+	PrevHash   []byte
+	MerkleRoot []byte
+	Timestamp  int64
+	Difficulty int
+	Nonce      uint32
+	Height     int
+}
+
+// nonceOffset is the position of the nonce in the serialized header.
+const nonceOffset = 80
+
+// Serialize encodes the header in its fixed 92-byte form, all integers
+// big-endian:
+//
+//	version     4 bytes
+//	prev hash   32 bytes, zero for the genesis block
+//	merkle root 32 bytes
+//	timestamp   8 bytes, Unix seconds
+//	difficulty  4 bytes
+//	nonce       4 bytes
+//	height      8 bytes
+func (h *BlockHeader) Serialize() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, h.Version)
+	buf.Write(fixedHash(h.PrevHash))
+	buf.Write(fixedHash(h.MerkleRoot))
+	binary.Write(&buf, binary.BigEndian, h.Timestamp)
+	binary.Write(&buf, binary.BigEndian, uint32(h.Difficulty))
+	binary.Write(&buf, binary.BigEndian, h.Nonce)
+	binary.Write(&buf, binary.BigEndian, int64(h.Height))
+	return buf.Bytes()
+}
+
+func DeserializeHeader(data []byte) BlockHeader {
+	r := &reader{data: data}
+	header := readHeader(r)
+	HandleError(r.finish())
+	return header
+}
+
+func readHeader(r *reader) BlockHeader {
+	var h BlockHeader
+	h.Version = int32(r.uint32())
+	h.PrevHash = readHash(r)
+	h.MerkleRoot = readHash(r)
+	h.Timestamp = int64(r.uint64())
+	h.Difficulty = int(r.uint32())
+	h.Nonce = r.uint32()
+	h.Height = int(int64(r.uint64()))
+	return h
+}
+
+// readHash reads a 32-byte hash, returning nil for the zero hash the genesis
+// block has as its parent.
+func readHash(r *reader) []byte {
+	hash := r.next(sha256.Size)
+	if hash == nil || bytes.Equal(hash, make([]byte, sha256.Size)) {
+		return nil
+	}
+	return append([]byte{}, hash...)
+}
+
+// Hash returns the SHA-256 of the serialized header.
+func (h *BlockHeader) Hash() []byte {
+	hash := sha256.Sum256(h.Serialize())
+	return hash[:]
+}
+
+func fixedHash(hash []byte) []byte {
+	fixed := make([]byte, sha256.Size)
+	copy(fixed, hash)
+	return fixed
+}
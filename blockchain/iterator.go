@@ -1,10 +1,8 @@
 package blockchain
 
-import "github.com/dgraph-io/badger"
-
 type BlockChainIterator struct {
 	CurrentHash []byte
-	Database    *badger.DB
+	Database    Storage
 }
 
 func (bc *BlockChain) Iterator() *BlockChainIterator {
@@ -14,14 +12,9 @@ func (bc *BlockChain) Iterator() *BlockChainIterator {
 
 func (iter *BlockChainIterator) Next() *Block {
 	var block *Block
-	err := iter.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(iter.CurrentHash)
+	err := iter.Database.View(func(txn Txn) error {
+		encodedBlock, err := txn.Get(iter.CurrentHash)
 		HandleError(err)
-		var encodedBlock []byte
-		err = item.Value(func(val []byte) error {
-			encodedBlock = append([]byte{}, val...)
-			return nil
-		})
 		block = Deserialize(encodedBlock)
 		return err
 	})
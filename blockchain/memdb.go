@@ -0,0 +1,265 @@
+package blockchain
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var errReadOnly = errors.New("write in a read-only transaction")
+
+// MemoryStorage is a Storage kept in memory, for tests and simulations that
+// should not touch the disk. Its contents are lost when it is dropped.
+//
+// Every transaction reads the contents as they were when it started. Each
+// key keeps the values committed by recent updates, tagged with the version
+// that wrote them, until no running transaction can read them any more.
+// Updates run one at a time.
+type MemoryStorage struct {
+	mu      sync.RWMutex
+	data    map[string][]memValue
+	version uint64
+	// readers counts the running transactions reading each version, and
+	// stale holds the keys with values only they can read.
+	readers map[uint64]int
+	stale   map[string]bool
+
+	// update serializes read-write transactions and write batches.
+	update sync.Mutex
+}
+
+// memValue is the value of a key from version on. A nil value is a
+// deletion.
+type memValue struct {
+	version uint64
+	value   []byte
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		data:    make(map[string][]memValue),
+		readers: make(map[uint64]int),
+		stale:   make(map[string]bool),
+	}
+}
+
+func (s *MemoryStorage) View(fn func(txn Txn) error) error {
+	version := s.begin()
+	defer s.end(version)
+	return fn(&memTxn{s: s, version: version})
+}
+
+func (s *MemoryStorage) Update(fn func(txn Txn) error) error {
+	s.update.Lock()
+	defer s.update.Unlock()
+	// No other update can commit before this one, so its version needs no
+	// reader registered.
+	s.mu.RLock()
+	version := s.version
+	s.mu.RUnlock()
+	txn := &memTxn{s: s, version: version, writes: make(map[string][]byte)}
+	if err := fn(txn); err != nil {
+		return err
+	}
+	s.commit(txn.writes)
+	return nil
+}
+
+func (s *MemoryStorage) NewWriteBatch() WriteBatch {
+	return &memWriteBatch{s: s, writes: make(map[string][]byte)}
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+// begin registers a transaction reading the current version.
+func (s *MemoryStorage) begin() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readers[s.version]++
+	return s.version
+}
+
+func (s *MemoryStorage) end(version uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readers[version]--; s.readers[version] > 0 {
+		return
+	}
+	delete(s.readers, version)
+	oldest := s.oldestRead()
+	for k := range s.stale {
+		s.prune(k, oldest)
+	}
+}
+
+// oldestRead returns the oldest version a running transaction reads.
+func (s *MemoryStorage) oldestRead() uint64 {
+	oldest := s.version
+	for version := range s.readers {
+		oldest = min(oldest, version)
+	}
+	return oldest
+}
+
+// prune drops the values of key older than the one read at version oldest.
+func (s *MemoryStorage) prune(key string, oldest uint64) {
+	values := s.data[key]
+	keep := 0
+	for i, value := range values {
+		if value.version <= oldest {
+			keep = i
+		}
+	}
+	values = values[keep:]
+	switch {
+	case len(values) == 1 && values[0].value == nil:
+		delete(s.data, key)
+	case len(values) == 1:
+		s.data[key] = values
+	default:
+		s.data[key] = values
+		s.stale[key] = true
+		return
+	}
+	delete(s.stale, key)
+}
+
+// commit applies writes as a new version. Values of the written keys that
+// no running transaction can read are dropped.
+func (s *MemoryStorage) commit(writes map[string][]byte) {
+	if len(writes) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version++
+	oldest := s.oldestRead()
+	for k, v := range writes {
+		// Values are appended to a copy, since running transactions may
+		// be reading the old slice.
+		values := s.data[k]
+		s.data[k] = append(values[:len(values):len(values)], memValue{s.version, v})
+		s.prune(k, oldest)
+	}
+}
+
+// get returns the value of key at version, or nil.
+func (s *MemoryStorage) get(key string, version uint64) []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	values := s.data[key]
+	for i := len(values) - 1; i >= 0; i-- {
+		if values[i].version <= version {
+			return values[i].value
+		}
+	}
+	return nil
+}
+
+// keys returns the keys starting with prefix that have a value at version.
+func (s *MemoryStorage) keys(prefix string, version uint64) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []string
+	for k, values := range s.data {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		for i := len(values) - 1; i >= 0; i-- {
+			if values[i].version <= version {
+				if values[i].value != nil {
+					keys = append(keys, k)
+				}
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// memTxn reads the contents at version and records its own writes in
+// writes, which is nil for read-only transactions.
+type memTxn struct {
+	s       *MemoryStorage
+	version uint64
+	writes  map[string][]byte
+}
+
+func (t *memTxn) Get(key []byte) ([]byte, error) {
+	v, ok := t.writes[string(key)]
+	if !ok {
+		v = t.s.get(string(key), t.version)
+	}
+	if v == nil {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte{}, v...), nil
+}
+
+func (t *memTxn) Set(key, value []byte) error {
+	if t.writes == nil {
+		return errReadOnly
+	}
+	t.writes[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (t *memTxn) Delete(key []byte) error {
+	if t.writes == nil {
+		return errReadOnly
+	}
+	t.writes[string(key)] = nil
+	return nil
+}
+
+// Scan collects the matching keys before calling fn, so fn may write to the
+// transaction.
+func (t *memTxn) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	var keys []string
+	for _, k := range t.s.keys(string(prefix), t.version) {
+		if _, written := t.writes[k]; !written {
+			keys = append(keys, k)
+		}
+	}
+	for k, v := range t.writes {
+		if v != nil && strings.HasPrefix(k, string(prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, err := t.Get([]byte(k))
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err := fn([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type memWriteBatch struct {
+	s      *MemoryStorage
+	writes map[string][]byte
+}
+
+func (b *memWriteBatch) Set(key, value []byte) error {
+	b.writes[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (b *memWriteBatch) Flush() error {
+	b.s.update.Lock()
+	defer b.s.update.Unlock()
+	b.s.commit(b.writes)
+	b.writes = make(map[string][]byte)
+	return nil
+}
+
+func (b *memWriteBatch) Cancel() {
+	b.writes = make(map[string][]byte)
+}
@@ -0,0 +1,137 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func set(t *testing.T, s Storage, key, value string) {
+	t.Helper()
+	err := s.Update(func(txn Txn) error {
+		if value == "" {
+			return txn.Delete([]byte(key))
+		}
+		return txn.Set([]byte(key), []byte(value))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(txn Txn, key string) string {
+	v, err := txn.Get([]byte(key))
+	if err == ErrKeyNotFound {
+		return ""
+	}
+	return string(v)
+}
+
+func TestMemoryStorageSnapshots(t *testing.T) {
+	s := NewMemoryStorage()
+	set(t, s, "a", "1")
+	set(t, s, "b", "1")
+
+	err := s.View(func(txn Txn) error {
+		set(t, s, "a", "2")
+		set(t, s, "b", "")
+		set(t, s, "c", "2")
+		if get(txn, "a") != "1" || get(txn, "b") != "1" || get(txn, "c") != "" {
+			t.Error("a view sees writes committed after it started")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.View(func(txn Txn) error {
+		if get(txn, "a") != "2" || get(txn, "b") != "" || get(txn, "c") != "2" {
+			t.Error("a new view misses committed writes")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the values running views can read are kept.
+	for i := 0; i < 100; i++ {
+		set(t, s, "a", fmt.Sprint(i))
+	}
+	if n := len(s.data["a"]); n != 1 {
+		t.Errorf("key a keeps %d values, want 1", n)
+	}
+	if _, ok := s.data["b"]; ok {
+		t.Error("a deleted key is still stored")
+	}
+}
+
+func TestMemoryStorageUpdate(t *testing.T) {
+	s := NewMemoryStorage()
+	set(t, s, "k1", "old")
+	failed := errors.New("failed")
+	err := s.Update(func(txn Txn) error {
+		txn.Set([]byte("k1"), []byte("new"))
+		txn.Set([]byte("k2"), []byte("new"))
+		if get(txn, "k1") != "new" {
+			t.Error("an update does not see its own writes")
+		}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("Update = %v, want %v", err, failed)
+	}
+	err = s.View(func(txn Txn) error {
+		if get(txn, "k1") != "old" || get(txn, "k2") != "" {
+			t.Error("a failed update was committed")
+		}
+		if err := txn.Set([]byte("k3"), nil); err != errReadOnly {
+			t.Errorf("Set in a view = %v, want %v", err, errReadOnly)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryStorageScan(t *testing.T) {
+	s := NewMemoryStorage()
+	for _, k := range []string{"p-3", "p-1", "q-1", "p-2"} {
+		set(t, s, k, k)
+	}
+	err := s.Update(func(txn Txn) error {
+		txn.Delete([]byte("p-2"))
+		txn.Set([]byte("p-0"), []byte("p-0"))
+		var keys []string
+		err := txn.Scan([]byte("p-"), func(k, v []byte) error {
+			keys = append(keys, string(k))
+			// Writing while scanning must not disturb the scan.
+			return txn.Set([]byte("p-9"), v)
+		})
+		if got := fmt.Sprint(keys); got != "[p-0 p-1 p-3]" {
+			t.Errorf("Scan visited %s, want [p-0 p-1 p-3]", got)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wb := s.NewWriteBatch()
+	wb.Set([]byte("p-5"), []byte("p-5"))
+	wb.Cancel()
+	wb.Set([]byte("p-6"), []byte("p-6"))
+	if err := wb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	err = s.View(func(txn Txn) error {
+		if get(txn, "p-5") != "" || get(txn, "p-6") != "p-6" {
+			t.Error("the write batch did not commit exactly the writes since Cancel")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,11 +1,19 @@
 package blockchain
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"errors"
 )
 
+// MerkleTree is built over the IDs of a block's transactions. Leaves are the
+// SHA-256 of each ID and every parent is the SHA-256 of its two children
+// concatenated. A level with an odd number of nodes pairs its last node with
+// itself.
 type MerkleTree struct {
 	Root *MerkleNode
+	// levels holds every level of the tree, leaves first.
+	levels [][]*MerkleNode
 }
 
 type MerkleNode struct {
@@ -14,6 +22,16 @@ type MerkleNode struct {
 	Data  []byte
 }
 
+// MerkleStep is one sibling on the path from a leaf to the root. Left is
+// set when the sibling is the left-hand child.
+type MerkleStep struct {
+	Hash []byte
+	Left bool
+}
+
+// MerkleProof lists the siblings from a leaf up to the root.
+type MerkleProof []MerkleStep
+
 func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	node := MerkleNode{}
 
@@ -21,9 +39,7 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 		hash := sha256.Sum256(data)
 		node.Data = hash[:]
 	} else {
-		prevHashes := append(left.Data, right.Data...)
-		hash := sha256.Sum256(prevHashes)
-		node.Data = hash[:]
+		node.Data = hashPair(left.Data, right.Data)
 	}
 
 	node.Left = left
@@ -32,26 +48,73 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 }
 
 func NewMerkleTree(data [][]byte) *MerkleTree {
-
-	var nodes []MerkleNode
-	if len(data)%2 != 0 {
-		data = append(data, data[len(data)-1])
-	}
+	var nodes []*MerkleNode
 	for _, d := range data {
-		nodes = append(nodes, *NewMerkleNode(nil, nil, d))
+		nodes = append(nodes, NewMerkleNode(nil, nil, d))
+	}
+	if len(nodes) == 0 {
+		nodes = append(nodes, NewMerkleNode(nil, nil, nil))
 	}
 
-	for i := 0; i < len(data)/2; i ++ {
-		var newLevel []MerkleNode
+	tree := &MerkleTree{}
+	for len(nodes) > 1 {
+		tree.levels = append(tree.levels, nodes)
+		var level []*MerkleNode
 		for j := 0; j < len(nodes); j += 2 {
-			if i+1 < len(nodes) {
-				newLevel = append(newLevel, *NewMerkleNode(&nodes[i], &nodes[i+1], nil))
-			} else {
-				newLevel = append(newLevel, nodes[i]) // Odd node, carry it over
+			right := nodes[j]
+			if j+1 < len(nodes) {
+				right = nodes[j+1]
 			}
+			level = append(level, NewMerkleNode(nodes[j], right, nil))
+		}
+		nodes = level
+	}
+	tree.levels = append(tree.levels, nodes)
+	tree.Root = nodes[0]
+	return tree
+}
+
+// Proof returns the path proving that txID is one of the tree's leaves.
+func (t *MerkleTree) Proof(txID []byte) (MerkleProof, error) {
+	leaf := sha256.Sum256(txID)
+	index := -1
+	for i, node := range t.levels[0] {
+		if bytes.Equal(node.Data, leaf[:]) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, errors.New("transaction is not in the tree")
+	}
+
+	var proof MerkleProof
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			sibling = index
 		}
-		nodes = newLevel
+		proof = append(proof, MerkleStep{level[sibling].Data, sibling < index})
+		index /= 2
 	}
+	return proof, nil
+}
+
+// VerifyProof reports whether proof links txID to the merkle root.
+func VerifyProof(root, txID []byte, proof MerkleProof) bool {
+	leaf := sha256.Sum256(txID)
+	hash := leaf[:]
+	for _, step := range proof {
+		if step.Left {
+			hash = hashPair(step.Hash, hash)
+		} else {
+			hash = hashPair(hash, step.Hash)
+		}
+	}
+	return bytes.Equal(hash, root)
+}
 
-	return &MerkleTree{Root: &nodes[0]}
+func hashPair(left, right []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{}, left...), right...))
+	return hash[:]
 }
@@ -0,0 +1,66 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestMerkleProofs(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		t.Run(fmt.Sprintf("%d leaves", n), func(t *testing.T) {
+			var ids [][]byte
+			for i := 0; i < n; i++ {
+				ids = append(ids, []byte(fmt.Sprintf("transaction %d", i)))
+			}
+			tree := NewMerkleTree(ids)
+			for _, id := range ids {
+				proof, err := tree.Proof(id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !VerifyProof(tree.Root.Data, id, proof) {
+					t.Errorf("proof of %q does not verify", id)
+				}
+				if VerifyProof(tree.Root.Data, []byte("other"), proof) {
+					t.Errorf("proof of %q verifies another ID", id)
+				}
+				// A leaf without a sibling is paired with itself, and its
+				// proof is the same whichever side the step names.
+				if len(proof) > 0 && !bytes.Equal(proof[0].Hash, leafHash(id)) {
+					proof[0].Left = !proof[0].Left
+					if VerifyProof(tree.Root.Data, id, proof) {
+						t.Errorf("proof of %q verifies with a flipped step", id)
+					}
+				}
+			}
+			if _, err := tree.Proof([]byte("missing")); err == nil {
+				t.Error("proved an ID that is not in the tree")
+			}
+		})
+	}
+}
+
+func TestMerkleRootCoversBlock(t *testing.T) {
+	chain, alice := newTestChain(t)
+	block := mineTxs(t, chain, string(alice.Address()))
+	if !bytes.Equal(block.HashTransactions(), block.MerkleRoot) {
+		t.Fatal("the mined block's merkle root does not match its transactions")
+	}
+	proof, err := block.MerkleTree().Proof(block.Transactions[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyProof(block.MerkleRoot, block.Transactions[0].ID, proof) {
+		t.Error("the coinbase proof does not verify against the header")
+	}
+
+	block.Transactions = append(block.Transactions, CoinbaseTx(string(alice.Address()), "", 1))
+	if err := CheckBlock(chain.Engine, block); err == nil {
+		t.Error("a block with a transaction added after mining passed CheckBlock")
+	}
+}
+
+func leafHash(id []byte) []byte {
+	return NewMerkleNode(nil, nil, id).Data
+}
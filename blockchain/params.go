@@ -0,0 +1,195 @@
+package blockchain
+
+import (
+	"fmt"
+
+	"github.com/nthskyradiated/go-bc/wallet"
+)
+
+// Checkpoint pins the block at Height to the one with hash Hash, in hex.
+type Checkpoint struct {
+	Height int
+	Hash   string
+}
+
+// ChainParams holds the consensus parameters of a network.
+type ChainParams struct {
+	Name string
+	// InitialSubsidy is the subsidy of the first HalvingInterval blocks.
+	// It halves every HalvingInterval blocks after that.
+	InitialSubsidy  int
+	HalvingInterval int
+	// MaxSupply caps the coins ever created by coinbase subsidies. No
+	// output, and no transaction in total, may be worth more.
+	MaxSupply int
+	// CoinbaseMaturity is the number of blocks a coinbase output must wait
+	// before it can be spent.
+	CoinbaseMaturity int
+	// MaxBlockSize bounds the serialized size of a block in bytes, and
+	// MaxBlockTransactions the number of transactions in it.
+	MaxBlockSize         int
+	MaxBlockTransactions int
+	// MaxFutureDrift is how many seconds a block timestamp may be ahead of
+	// the adjusted clock.
+	MaxFutureDrift int64
+	// InitialDifficulty is the difficulty of the genesis block. With
+	// NoRetargeting every later block keeps it.
+	InitialDifficulty int
+	NoRetargeting     bool
+	// Checkpoints are blocks known to be on the chain. The block at a
+	// checkpoint height must have its hash, and once the chain has passed a
+	// checkpoint no block may branch off at or below it.
+	Checkpoints []Checkpoint
+	// AssumeValid is a block whose history is known to be valid. It is
+	// enforced like a checkpoint, so any chain reaching its height contains
+	// it. Blocks below it are stored without becoming the tip until it
+	// arrives, and its ancestors are then connected without checking their
+	// signatures.
+	AssumeValid Checkpoint
+	// DBPath is the database directory of a node, formatted with the node
+	// ID.
+	DBPath string
+	// Wallet holds the address prefixes and wallet file of the network.
+	Wallet *wallet.Network
+}
+
+var MainNetParams = ChainParams{
+	Name:            "main",
+	InitialSubsidy:  20,
+	HalvingInterval: 1000,
+	MaxSupply:       35000,
+
+	CoinbaseMaturity: 10,
+
+	MaxBlockSize:         1 << 20,
+	MaxBlockTransactions: 2000,
+
+	MaxFutureDrift: 2 * 60 * 60,
+
+	InitialDifficulty: 12,
+
+	// Every chain starts from its own genesis block, so there are no
+	// checkpoints to ship yet.
+	Checkpoints: nil,
+	AssumeValid: Checkpoint{},
+
+	DBPath: "./tmp/blocks_%s",
+	Wallet: &wallet.MainNet,
+}
+
+// RegTestParams describe a local network for tests, where every hash is
+// likely to meet the difficulty so blocks can be mined on demand. It keeps
+// its chains and wallets apart from the main network.
+var RegTestParams = ChainParams{
+	Name:            "regtest",
+	InitialSubsidy:  20,
+	HalvingInterval: 150,
+	MaxSupply:       35000,
+
+	CoinbaseMaturity: 10,
+
+	MaxBlockSize:         1 << 20,
+	MaxBlockTransactions: 2000,
+
+	MaxFutureDrift: 2 * 60 * 60,
+
+	InitialDifficulty: MinDifficulty,
+	NoRetargeting:     true,
+
+	DBPath: "./tmp/regtest_blocks_%s",
+	Wallet: &wallet.RegTest,
+}
+
+// Params are the parameters of the network the node runs on.
+var Params = &MainNetParams
+
+// SelectNetwork makes the node run on the network called name, "main" or
+// "regtest".
+func SelectNetwork(name string) error {
+	for _, params := range []*ChainParams{&MainNetParams, &RegTestParams} {
+		if params.Name == name {
+			Params = params
+			wallet.Net = params.Wallet
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown network %q", name)
+}
+
+// CheckpointHash returns the hash, in hex, the block at height must have, if
+// height is a checkpoint or the assume-valid block.
+func (p *ChainParams) CheckpointHash(height int) (string, bool) {
+	if p.AssumeValid.Hash != "" && p.AssumeValid.Height == height {
+		return p.AssumeValid.Hash, true
+	}
+	for _, cp := range p.Checkpoints {
+		if cp.Height == height {
+			return cp.Hash, true
+		}
+	}
+	return "", false
+}
+
+// LastCheckpoint returns the height of the highest checkpoint at or below
+// height, or -1 if there is none.
+func (p *ChainParams) LastCheckpoint(height int) int {
+	last := -1
+	if p.AssumeValid.Hash != "" && p.AssumeValid.Height <= height {
+		last = p.AssumeValid.Height
+	}
+	for _, cp := range p.Checkpoints {
+		if cp.Height <= height && cp.Height > last {
+			last = cp.Height
+		}
+	}
+	return last
+}
+
+// AssumedValid reports whether a block at height may be an ancestor of the
+// assume-valid block, whose signatures need not be checked.
+func (p *ChainParams) AssumedValid(height int) bool {
+	return p.AssumeValid.Hash != "" && height <= p.AssumeValid.Height
+}
+
+// Subsidy returns the amount the coinbase of the block at height may create
+// on top of the fees of the block.
+func (p *ChainParams) Subsidy(height int) int {
+	issued := p.issuedBefore(height)
+	subsidy := p.scheduledSubsidy(height)
+	if issued+subsidy > p.MaxSupply {
+		subsidy = p.MaxSupply - issued
+	}
+	return subsidy
+}
+
+// TotalIssued returns the coins created by the subsidies of the blocks up to
+// and including height.
+func (p *ChainParams) TotalIssued(height int) int {
+	return p.issuedBefore(height + 1)
+}
+
+func (p *ChainParams) scheduledSubsidy(height int) int {
+	halvings := height / p.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return p.InitialSubsidy >> halvings
+}
+
+// issuedBefore sums the subsidies of the blocks below height, one halving
+// interval at a time.
+func (p *ChainParams) issuedBefore(height int) int {
+	total := 0
+	for start := 0; start < height; start += p.HalvingInterval {
+		subsidy := p.scheduledSubsidy(start)
+		if subsidy == 0 {
+			break
+		}
+		blocks := min(p.HalvingInterval, height-start)
+		total += blocks * subsidy
+		if total >= p.MaxSupply {
+			return p.MaxSupply
+		}
+	}
+	return total
+}
@@ -2,12 +2,17 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"log"
 	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Take data from the block
@@ -22,7 +27,31 @@ import (
 // 1. The hash must start with a certain number of zeros
 // 2. The hash must be less than a target value
 
-const Difficulty = 12
+// The difficulty of a block is the number of leading zero bits its hash
+// must have. It starts at the InitialDifficulty of the network and, unless
+// the network disables retargeting, every RetargetInterval blocks is moved
+// towards the value that would have produced one block every
+// TargetBlockTime seconds over the last interval.
+const (
+	MinDifficulty     = 1
+	MaxDifficulty     = 255
+	TargetBlockTime   = 10
+	RetargetInterval  = 10
+	// maxRetargetStep bounds a single adjustment to a factor of four.
+	maxRetargetStep = 2
+)
+
+// MiningWorkers is the number of goroutines that search for a nonce.
+var MiningWorkers = runtime.NumCPU()
+
+const (
+	// checkInterval is how many nonces a mining worker tries between
+	// checks for cancellation.
+	checkInterval = 1 << 14
+	// hashrateInterval is how often a running miner reports its hashrate.
+	hashrateInterval = 10 * time.Second
+)
+
 type ProofOfWork struct {
 	Block  *Block
 	Target *big.Int
@@ -30,49 +59,170 @@ type ProofOfWork struct {
 
 func NewProofOfWork(b *Block) *ProofOfWork {
 	target := big.NewInt(1)
-	target.Lsh(target, uint(256-Difficulty))
+	target.Lsh(target, uint(256-b.Difficulty))
 	pow := &ProofOfWork{b, target}
 	return pow
 }
 
-func (pow *ProofOfWork) PrepareData(nonce int) []byte {
-	data := bytes.Join([][]byte{
-		pow.Block.PrevHash,
-		pow.Block.HashTransactions(),
-		ToHex(int64(nonce)),
-		ToHex(int64(Difficulty)),
-
-	}, []byte{})
-	return data
+// PrepareData returns the serialized block header with the given nonce,
+// which is exactly what the block hash is computed over.
+func (pow *ProofOfWork) PrepareData(nonce uint32) []byte {
+	header := pow.Block.BlockHeader
+	header.Nonce = nonce
+	return header.Serialize()
 }
 
-func (pow *ProofOfWork) Run() (int, []byte) {
-	var initHash = new(big.Int)
-	nonce := 0
-	var hash [32]byte
-	for nonce < math.MaxInt64 {
-		data := pow.PrepareData(nonce)
-		hash = sha256.Sum256(data)
-		fmt.Printf("Nonce: %d, Hash: %x\n", nonce, hash)
-		initHash.SetBytes(hash[:])
-		if initHash.Cmp(pow.Target) == -1 {
-			break
-		} else {
-			nonce++
+// Run searches for a nonce that meets the target, splitting the nonce space
+// between workers goroutines. If every nonce fails the block timestamp is
+// moved forward and the search starts again. Run stops with ctx's error when
+// ctx is cancelled.
+func (pow *ProofOfWork) Run(ctx context.Context, workers int) (uint32, []byte, error) {
+	workers = max(workers, 1)
+	var hashes atomic.Uint64
+	start := time.Now()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(hashrateInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fmt.Printf("Mining at %s\n", hashrate(hashes.Load(), time.Since(start)))
+			}
+		}
+	}()
+
+	for {
+		nonce, hash, found := pow.search(ctx, workers, &hashes)
+		if found {
+			fmt.Printf("Mined block with nonce %d in %s at %s\n", nonce,
+				time.Since(start).Round(time.Millisecond), hashrate(hashes.Load(), time.Since(start)))
+			return nonce, hash, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, nil, err
 		}
+		pow.Block.Timestamp++
 	}
-	fmt.Println("Mining Success!")
-	return nonce, hash[:]
+}
+
+// search tries every nonce with the current header. Worker i tries the
+// nonces i, i+workers, i+2*workers and so on.
+func (pow *ProofOfWork) search(ctx context.Context, workers int, hashes *atomic.Uint64) (uint32, []byte, bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		nonce uint32
+		hash  []byte
+	}
+	results := make(chan result, workers)
+	header := pow.PrepareData(0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(first uint64) {
+			defer wg.Done()
+			data := append([]byte{}, header...)
+			var value big.Int
+			tried := uint64(0)
+			for nonce := first; nonce <= math.MaxUint32; nonce += uint64(workers) {
+				if tried == checkInterval {
+					hashes.Add(tried)
+					tried = 0
+					if ctx.Err() != nil {
+						return
+					}
+				}
+				binary.BigEndian.PutUint32(data[nonceOffset:], uint32(nonce))
+				hash := sha256.Sum256(data)
+				tried++
+				if value.SetBytes(hash[:]).Cmp(pow.Target) == -1 {
+					hashes.Add(tried)
+					results <- result{uint32(nonce), hash[:]}
+					cancel()
+					return
+				}
+			}
+			hashes.Add(tried)
+		}(uint64(i))
+	}
+	wg.Wait()
+	close(results)
+
+	r, found := <-results
+	return r.nonce, r.hash, found
+}
+
+func hashrate(hashes uint64, elapsed time.Duration) string {
+	rate := float64(hashes) / max(elapsed.Seconds(), 0.001)
+	switch {
+	case rate >= 1e6:
+		return fmt.Sprintf("%.2f MH/s", rate/1e6)
+	case rate >= 1e3:
+		return fmt.Sprintf("%.2f kH/s", rate/1e3)
+	}
+	return fmt.Sprintf("%.0f H/s", rate)
 }
 
 func (pow *ProofOfWork) Validate() bool {
 	var initHash = new(big.Int)
-	data := pow.PrepareData(pow.Block.Nonce)
-	hash := sha256.Sum256(data)
-	initHash.SetBytes(hash[:])
+	initHash.SetBytes(pow.Hash(pow.Block.Nonce))
 	return initHash.Cmp(pow.Target) == -1
 }
 
+// Hash returns the block hash for the given nonce.
+func (pow *ProofOfWork) Hash(nonce uint32) []byte {
+	hash := sha256.Sum256(pow.PrepareData(nonce))
+	return hash[:]
+}
+
+// Retarget returns the difficulty for a block at a retarget height, given
+// the difficulty of its parent and the seconds spanned by the last
+// RetargetInterval blocks.
+func Retarget(difficulty int, timespan int64) int {
+	expected := int64(TargetBlockTime * (RetargetInterval - 1))
+	if timespan < 1 {
+		timespan = 1
+	}
+	for step := 0; step < maxRetargetStep && timespan*2 <= expected; step++ {
+		difficulty++
+		timespan *= 2
+	}
+	for step := 0; step < maxRetargetStep && timespan >= expected*2; step++ {
+		difficulty--
+		timespan /= 2
+	}
+	return min(max(difficulty, MinDifficulty), MaxDifficulty)
+}
+
+// nextDifficulty returns the difficulty required of a block built on parent.
+func nextDifficulty(txn Txn, parent *Block) (int, error) {
+	if Params.NoRetargeting || (parent.Height+1)%RetargetInterval != 0 {
+		return parent.Difficulty, nil
+	}
+	first := parent
+	for i := 1; i < RetargetInterval; i++ {
+		var err error
+		if first, err = getBlock(txn, first.PrevHash); err != nil {
+			return 0, err
+		}
+	}
+	return Retarget(parent.Difficulty, parent.Timestamp-first.Timestamp), nil
+}
+
+// Work returns the expected number of hashes needed to meet the target,
+// which is what fork choice sums along a chain.
+func (pow *ProofOfWork) Work() *big.Int {
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, new(big.Int).Add(pow.Target, big.NewInt(1)))
+}
+
 func ToHex(num int64)[]byte {
 	buff := new(bytes.Buffer)
 	err := binary.Write(buff, binary.BigEndian, num)
@@ -0,0 +1,143 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	pruneDepthKey   = []byte("prunedepth")
+	prunedHeightKey = []byte("prunedheight")
+)
+
+// MinPruneDepth is the smallest prune depth. Blocks this deep are assumed
+// never to be reorganized away, since their undo data is deleted with their
+// transactions.
+const MinPruneDepth = 20
+
+var ErrPruned = errors.New("block transactions have been pruned")
+
+// Pruned reports whether only the header of the block is stored. Every full
+// block holds at least its coinbase.
+func (b *Block) Pruned() bool {
+	return len(b.Transactions) == 0
+}
+
+// EnablePruning makes the node keep the transactions of only the last depth
+// blocks of the main chain, and prunes the older ones right away.
+func (bc *BlockChain) EnablePruning(depth int) error {
+	if depth < MinPruneDepth {
+		return fmt.Errorf("prune depth must be at least %d", MinPruneDepth)
+	}
+	err := bc.Database.Update(func(txn Txn) error {
+		return txn.Set(pruneDepthKey, binary.BigEndian.AppendUint64(nil, uint64(depth)))
+	})
+	if err != nil {
+		return err
+	}
+	bc.PruneDepth = depth
+	_, err = bc.Prune()
+	return err
+}
+
+// Prune deletes the transactions, undo data and transaction index entries of
+// the main chain blocks more than PruneDepth blocks below the tip, keeping
+// their headers. The UTXO set and address index are left untouched. It
+// returns the number of blocks pruned.
+func (bc *BlockChain) Prune() (int, error) {
+	if bc.PruneDepth == 0 {
+		return 0, nil
+	}
+	var blocks []*Block
+	err := bc.Database.View(func(txn Txn) error {
+		prunedHeight, err := getPrunedHeight(txn)
+		if err != nil {
+			return err
+		}
+		hash, err := getLastHash(txn)
+		if err != nil {
+			return err
+		}
+		tip, err := getBlock(txn, hash)
+		if err != nil {
+			return err
+		}
+		pruneTo := tip.Height - bc.PruneDepth
+		for block := tip; block.Height > prunedHeight; {
+			if block.Height <= pruneTo {
+				blocks = append(blocks, block)
+			}
+			if len(block.PrevHash) == 0 {
+				break
+			}
+			if block, err = getBlock(txn, block.PrevHash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Oldest first, one transaction per block, so the pruned height is
+	// correct even if pruning stops part way.
+	for i := len(blocks) - 1; i >= 0; i-- {
+		block := blocks[i]
+		err := bc.Database.Update(func(txn Txn) error {
+			if bc.TxIndex {
+				if err := unindexBlock(txn, block); err != nil {
+					return err
+				}
+			}
+			if err := txn.Delete(prefixedKey(undoPrefix, block.Hash)); err != nil {
+				return err
+			}
+			header := &Block{BlockHeader: block.BlockHeader, Signature: block.Signature}
+			if err := txn.Set(block.Hash, header.Serialize()); err != nil {
+				return err
+			}
+			return txn.Set(prunedHeightKey, binary.BigEndian.AppendUint64(nil, uint64(block.Height)))
+		})
+		if err != nil {
+			return len(blocks) - 1 - i, err
+		}
+	}
+	return len(blocks), nil
+}
+
+// PrunedHeight returns the height of the highest pruned block, or -1 if no
+// block has been pruned.
+func (bc *BlockChain) PrunedHeight() int {
+	var height int
+	err := bc.Database.View(func(txn Txn) error {
+		var err error
+		height, err = getPrunedHeight(txn)
+		return err
+	})
+	HandleError(err)
+	return height
+}
+
+func getPrunedHeight(txn Txn) (int, error) {
+	v, err := txn.Get(prunedHeightKey)
+	if err == ErrKeyNotFound {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint64(v)), nil
+}
+
+func getPruneDepth(txn Txn) (int, error) {
+	v, err := txn.Get(pruneDepthKey)
+	if err == ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint64(v)), nil
+}
@@ -0,0 +1,499 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nthskyradiated/go-bc/wallet"
+)
+
+// Scripts are a small stack language modelled on Bitcoin's. An output is
+// locked by a script (ScriptPubKey) and an input unlocks it with a script
+// of data pushes (ScriptSig). The input is valid when running the unlocking
+// script followed by the locking script leaves a true value on the stack.
+const (
+	OP_0              = 0x00
+	OP_PUSHDATA1      = 0x4c
+	OP_PUSHDATA2      = 0x4d
+	OP_1              = 0x51
+	OP_16             = 0x60
+	OP_VERIFY         = 0x69
+	OP_RETURN         = 0x6a
+	OP_DROP           = 0x75
+	OP_DUP            = 0x76
+	OP_EQUAL          = 0x87
+	OP_EQUALVERIFY    = 0x88
+	OP_SHA256         = 0xa8
+	OP_HASH160        = 0xa9
+	OP_CHECKSIG       = 0xac
+	OP_CHECKSIGVERIFY = 0xad
+
+	OP_CHECKMULTISIG       = 0xae
+	OP_CHECKMULTISIGVERIFY = 0xaf
+)
+
+const (
+	maxScriptSize        = 10000
+	maxScriptElementSize = 520
+	maxStackSize         = 1000
+	// MaxMultisigKeys keeps a multisig redeem script of uncompressed keys
+	// within maxScriptElementSize.
+	MaxMultisigKeys = 7
+)
+
+var opcodeNames = map[byte]string{
+	OP_0:              "OP_0",
+	OP_PUSHDATA1:      "OP_PUSHDATA1",
+	OP_PUSHDATA2:      "OP_PUSHDATA2",
+	OP_VERIFY:         "OP_VERIFY",
+	OP_RETURN:         "OP_RETURN",
+	OP_DROP:           "OP_DROP",
+	OP_DUP:            "OP_DUP",
+	OP_EQUAL:          "OP_EQUAL",
+	OP_EQUALVERIFY:    "OP_EQUALVERIFY",
+	OP_SHA256:         "OP_SHA256",
+	OP_HASH160:        "OP_HASH160",
+	OP_CHECKSIG:       "OP_CHECKSIG",
+	OP_CHECKSIGVERIFY: "OP_CHECKSIGVERIFY",
+
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+}
+
+var (
+	ErrScriptMalformed   = errors.New("script is malformed")
+	ErrScriptTooLarge    = errors.New("script exceeds the size limits")
+	ErrScriptNotPushOnly = errors.New("unlocking script may only push data")
+	ErrScriptBadOpcode   = errors.New("script uses an unknown opcode")
+	ErrScriptUnderflow   = errors.New("script reads from an empty stack")
+	ErrScriptReturn      = errors.New("script executed OP_RETURN")
+	ErrScriptVerify      = errors.New("script verification failed")
+	ErrScriptFalse       = errors.New("script evaluated to false")
+	ErrScriptMultisig    = errors.New("script has a malformed multisig")
+)
+
+// SigChecker reports whether sig is a valid signature by pubKey over the
+// transaction input being verified.
+type SigChecker func(sig, pubKey []byte) bool
+
+type scriptOp struct {
+	opcode byte
+	data   []byte
+}
+
+// parseScript splits script into opcodes, attaching the pushed bytes to the
+// data push opcodes.
+func parseScript(script []byte) ([]scriptOp, error) {
+	var ops []scriptOp
+	for pc := 0; pc < len(script); {
+		opcode := script[pc]
+		pc++
+		size := 0
+		switch {
+		case opcode > OP_0 && opcode < OP_PUSHDATA1:
+			size = int(opcode)
+		case opcode == OP_PUSHDATA1:
+			if pc+1 > len(script) {
+				return nil, ErrScriptMalformed
+			}
+			size = int(script[pc])
+			pc++
+		case opcode == OP_PUSHDATA2:
+			if pc+2 > len(script) {
+				return nil, ErrScriptMalformed
+			}
+			size = int(binary.LittleEndian.Uint16(script[pc:]))
+			pc += 2
+		}
+		if pc+size > len(script) {
+			return nil, ErrScriptMalformed
+		}
+		ops = append(ops, scriptOp{opcode, script[pc : pc+size]})
+		pc += size
+	}
+	return ops, nil
+}
+
+func isPush(opcode byte) bool {
+	return opcode <= OP_PUSHDATA2 || (opcode >= OP_1 && opcode <= OP_16)
+}
+
+// pushData appends the smallest push of data to script.
+func pushData(script, data []byte) []byte {
+	switch {
+	case len(data) == 0:
+		script = append(script, OP_0)
+	case len(data) < OP_PUSHDATA1:
+		script = append(script, byte(len(data)))
+	case len(data) <= 0xff:
+		script = append(script, OP_PUSHDATA1, byte(len(data)))
+	default:
+		script = append(script, OP_PUSHDATA2)
+		script = binary.LittleEndian.AppendUint16(script, uint16(len(data)))
+	}
+	return append(script, data...)
+}
+
+// P2PKHScript locks an output to the owner of the public key whose hash is
+// pubKeyHash: OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG.
+func P2PKHScript(pubKeyHash []byte) []byte {
+	script := []byte{OP_DUP, OP_HASH160}
+	script = pushData(script, pubKeyHash)
+	return append(script, OP_EQUALVERIFY, OP_CHECKSIG)
+}
+
+// P2PKHUnlockScript unlocks a P2PKH output: <sig> <pubKey>.
+func P2PKHUnlockScript(sig, pubKey []byte) []byte {
+	return pushData(pushData(nil, sig), pubKey)
+}
+
+// MultisigScript requires m signatures matching m of pubKeys:
+// OP_m <pubKey>... OP_n OP_CHECKMULTISIG. It is used as the redeem script of
+// a pay-to-script-hash output.
+func MultisigScript(m int, pubKeys [][]byte) ([]byte, error) {
+	if len(pubKeys) == 0 || len(pubKeys) > MaxMultisigKeys {
+		return nil, fmt.Errorf("multisig needs between 1 and %d public keys", MaxMultisigKeys)
+	}
+	if m < 1 || m > len(pubKeys) {
+		return nil, fmt.Errorf("multisig cannot require %d of %d signatures", m, len(pubKeys))
+	}
+	script := []byte{byte(OP_1 + m - 1)}
+	for _, pubKey := range pubKeys {
+		script = pushData(script, pubKey)
+	}
+	return append(script, byte(OP_1+len(pubKeys)-1), OP_CHECKMULTISIG), nil
+}
+
+// ParseMultisigScript returns the required signature count and the public
+// keys of a script built by MultisigScript.
+func ParseMultisigScript(script []byte) (int, [][]byte, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) < 4 || ops[len(ops)-1].opcode != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+	m := int(ops[0].opcode) - OP_1 + 1
+	n := int(ops[len(ops)-2].opcode) - OP_1 + 1
+	if n != len(ops)-3 || m < 1 || m > n {
+		return 0, nil, false
+	}
+	var pubKeys [][]byte
+	for _, op := range ops[1 : len(ops)-2] {
+		if op.opcode == OP_0 || op.opcode > OP_PUSHDATA2 {
+			return 0, nil, false
+		}
+		pubKeys = append(pubKeys, op.data)
+	}
+	return m, pubKeys, true
+}
+
+// P2SHScript locks an output to the script whose hash is scriptHash:
+// OP_HASH160 <scriptHash> OP_EQUAL. It is spent by pushing the data the
+// script needs followed by the script itself.
+func P2SHScript(scriptHash []byte) []byte {
+	script := []byte{OP_HASH160}
+	script = pushData(script, scriptHash)
+	return append(script, OP_EQUAL)
+}
+
+// MultisigUnlockScript spends a P2SH multisig output: <sig>... <redeemScript>.
+// The signatures must be in the same order as their keys in the script.
+func MultisigUnlockScript(sigs [][]byte, redeemScript []byte) []byte {
+	var script []byte
+	for _, sig := range sigs {
+		script = pushData(script, sig)
+	}
+	return pushData(script, redeemScript)
+}
+
+// ExtractScriptHash returns the script hash a P2SH locking script pays to, or
+// nil for any other script.
+func ExtractScriptHash(script []byte) []byte {
+	ops, err := parseScript(script)
+	if err != nil {
+		return nil
+	}
+	if len(ops) == 3 && ops[0].opcode == OP_HASH160 && len(ops[1].data) == 20 && ops[2].opcode == OP_EQUAL {
+		return ops[1].data
+	}
+	return nil
+}
+
+// ExtractPubKeyHash returns the hash a standard locking script pays to, or
+// nil for any other script.
+func ExtractPubKeyHash(script []byte) []byte {
+	ops, err := parseScript(script)
+	if err != nil {
+		return nil
+	}
+	if len(ops) == 5 && ops[0].opcode == OP_DUP && ops[1].opcode == OP_HASH160 &&
+		len(ops[2].data) == 20 && ops[3].opcode == OP_EQUALVERIFY && ops[4].opcode == OP_CHECKSIG {
+		return ops[2].data
+	}
+	return nil
+}
+
+// pushedData returns the data pushed by a push-only script.
+func pushedData(script []byte) [][]byte {
+	ops, err := parseScript(script)
+	if err != nil {
+		return nil
+	}
+	var data [][]byte
+	for _, op := range ops {
+		data = append(data, op.data)
+	}
+	return data
+}
+
+// DisassembleScript renders script as space separated opcodes, with pushed
+// data in hex.
+func DisassembleScript(script []byte) string {
+	ops, err := parseScript(script)
+	if err != nil {
+		return fmt.Sprintf("[malformed] %x", script)
+	}
+	var words []string
+	for _, op := range ops {
+		switch {
+		case op.opcode > OP_0 && op.opcode <= OP_PUSHDATA2:
+			words = append(words, hex.EncodeToString(op.data))
+		case op.opcode >= OP_1 && op.opcode <= OP_16:
+			words = append(words, fmt.Sprintf("OP_%d", op.opcode-OP_1+1))
+		case opcodeNames[op.opcode] != "":
+			words = append(words, opcodeNames[op.opcode])
+		default:
+			words = append(words, fmt.Sprintf("OP_UNKNOWN_%x", op.opcode))
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// VerifyScript runs the unlocking script scriptSig and then the locking
+// script scriptPubKey on the resulting stack. It returns nil if the top of
+// the stack is true when both have run. For a P2SH locking script the last
+// item pushed by scriptSig is then run as the redeem script on the items
+// below it, and must leave true on the stack as well.
+func VerifyScript(scriptSig, scriptPubKey []byte, checkSig SigChecker) error {
+	if len(scriptSig) > maxScriptSize || len(scriptPubKey) > maxScriptSize {
+		return ErrScriptTooLarge
+	}
+	sigOps, err := parseScript(scriptSig)
+	if err != nil {
+		return err
+	}
+	for _, op := range sigOps {
+		if !isPush(op.opcode) {
+			return ErrScriptNotPushOnly
+		}
+	}
+	pubKeyOps, err := parseScript(scriptPubKey)
+	if err != nil {
+		return err
+	}
+
+	var stack [][]byte
+	if stack, err = execute(sigOps, stack, checkSig); err != nil {
+		return err
+	}
+	redeemStack := append([][]byte{}, stack...)
+	if stack, err = execute(pubKeyOps, stack, checkSig); err != nil {
+		return err
+	}
+	if err := checkTop(stack); err != nil {
+		return err
+	}
+	if ExtractScriptHash(scriptPubKey) == nil {
+		return nil
+	}
+
+	redeemScript := redeemStack[len(redeemStack)-1]
+	redeemOps, err := parseScript(redeemScript)
+	if err != nil {
+		return err
+	}
+	if stack, err = execute(redeemOps, redeemStack[:len(redeemStack)-1], checkSig); err != nil {
+		return err
+	}
+	return checkTop(stack)
+}
+
+func checkTop(stack [][]byte) error {
+	if len(stack) == 0 || !castToBool(stack[len(stack)-1]) {
+		return ErrScriptFalse
+	}
+	return nil
+}
+
+func execute(ops []scriptOp, stack [][]byte, checkSig SigChecker) ([][]byte, error) {
+	pop := func() ([]byte, error) {
+		if len(stack) == 0 {
+			return nil, ErrScriptUnderflow
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return top, nil
+	}
+
+	for _, op := range ops {
+		if len(op.data) > maxScriptElementSize {
+			return nil, ErrScriptTooLarge
+		}
+		switch {
+		case op.opcode <= OP_PUSHDATA2:
+			stack = append(stack, op.data)
+		case op.opcode >= OP_1 && op.opcode <= OP_16:
+			stack = append(stack, []byte{op.opcode - OP_1 + 1})
+		case op.opcode == OP_VERIFY:
+			top, err := pop()
+			if err != nil {
+				return nil, err
+			}
+			if !castToBool(top) {
+				return nil, ErrScriptVerify
+			}
+		case op.opcode == OP_RETURN:
+			return nil, ErrScriptReturn
+		case op.opcode == OP_DROP:
+			if _, err := pop(); err != nil {
+				return nil, err
+			}
+		case op.opcode == OP_DUP:
+			if len(stack) == 0 {
+				return nil, ErrScriptUnderflow
+			}
+			stack = append(stack, stack[len(stack)-1])
+		case op.opcode == OP_EQUAL || op.opcode == OP_EQUALVERIFY:
+			a, err := pop()
+			if err != nil {
+				return nil, err
+			}
+			b, err := pop()
+			if err != nil {
+				return nil, err
+			}
+			equal := bytes.Equal(a, b)
+			if op.opcode == OP_EQUALVERIFY {
+				if !equal {
+					return nil, ErrScriptVerify
+				}
+				continue
+			}
+			stack = append(stack, boolBytes(equal))
+		case op.opcode == OP_SHA256:
+			top, err := pop()
+			if err != nil {
+				return nil, err
+			}
+			hash := sha256.Sum256(top)
+			stack = append(stack, hash[:])
+		case op.opcode == OP_HASH160:
+			top, err := pop()
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, wallet.PublicKeyHash(top))
+		case op.opcode == OP_CHECKSIG || op.opcode == OP_CHECKSIGVERIFY:
+			pubKey, err := pop()
+			if err != nil {
+				return nil, err
+			}
+			sig, err := pop()
+			if err != nil {
+				return nil, err
+			}
+			valid := checkSig(sig, pubKey)
+			if op.opcode == OP_CHECKSIGVERIFY {
+				if !valid {
+					return nil, ErrScriptVerify
+				}
+				continue
+			}
+			stack = append(stack, boolBytes(valid))
+		case op.opcode == OP_CHECKMULTISIG || op.opcode == OP_CHECKMULTISIGVERIFY:
+			popItems := func() ([][]byte, error) {
+				count, err := pop()
+				if err != nil {
+					return nil, err
+				}
+				n, ok := smallInt(count)
+				if !ok || n > MaxMultisigKeys || n > len(stack) {
+					return nil, ErrScriptMultisig
+				}
+				items := make([][]byte, n)
+				for i := n - 1; i >= 0; i-- {
+					items[i], _ = pop()
+				}
+				return items, nil
+			}
+			pubKeys, err := popItems()
+			if err != nil {
+				return nil, err
+			}
+			sigs, err := popItems()
+			if err != nil {
+				return nil, err
+			}
+			if len(sigs) > len(pubKeys) {
+				return nil, ErrScriptMultisig
+			}
+			// Each signature is matched against the keys after the one the
+			// previous signature matched, so they must be in key order.
+			valid, k := true, 0
+			for _, sig := range sigs {
+				for k < len(pubKeys) && !checkSig(sig, pubKeys[k]) {
+					k++
+				}
+				if k == len(pubKeys) {
+					valid = false
+					break
+				}
+				k++
+			}
+			if op.opcode == OP_CHECKMULTISIGVERIFY {
+				if !valid {
+					return nil, ErrScriptVerify
+				}
+				continue
+			}
+			stack = append(stack, boolBytes(valid))
+		default:
+			return nil, ErrScriptBadOpcode
+		}
+		if len(stack) > maxStackSize {
+			return nil, ErrScriptTooLarge
+		}
+	}
+	return stack, nil
+}
+
+// smallInt decodes a count pushed by OP_0 or OP_1 to OP_16.
+func smallInt(v []byte) (int, bool) {
+	switch len(v) {
+	case 0:
+		return 0, true
+	case 1:
+		return int(v[0]), v[0] <= 16
+	}
+	return 0, false
+}
+
+func castToBool(v []byte) bool {
+	for _, b := range v {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func boolBytes(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return []byte{}
+}
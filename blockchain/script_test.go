@@ -0,0 +1,174 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/nthskyradiated/go-bc/wallet"
+)
+
+// fakeSig is the signature testChecker accepts for pubKey.
+func fakeSig(pubKey []byte) []byte {
+	return append([]byte("sig:"), pubKey...)
+}
+
+func testChecker(sig, pubKey []byte) bool {
+	return bytes.Equal(sig, fakeSig(pubKey))
+}
+
+func TestVerifyP2PKHScript(t *testing.T) {
+	pubKey := []byte("public key")
+	lock := P2PKHScript(wallet.PublicKeyHash(pubKey))
+	if !bytes.Equal(ExtractPubKeyHash(lock), wallet.PublicKeyHash(pubKey)) {
+		t.Fatalf("ExtractPubKeyHash(%s) does not return the hash", DisassembleScript(lock))
+	}
+
+	tests := []struct {
+		name   string
+		unlock []byte
+		want   error
+	}{
+		{"valid", P2PKHUnlockScript(fakeSig(pubKey), pubKey), nil},
+		{"wrong signature", P2PKHUnlockScript(fakeSig([]byte("other")), pubKey), ErrScriptFalse},
+		{"wrong key", P2PKHUnlockScript(fakeSig([]byte("other")), []byte("other")), ErrScriptVerify},
+		{"empty", nil, ErrScriptUnderflow},
+		{"not push only", append(P2PKHUnlockScript(fakeSig(pubKey), pubKey), OP_DUP), ErrScriptNotPushOnly},
+		{"malformed", []byte{OP_PUSHDATA1, 10, 1}, ErrScriptMalformed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := VerifyScript(test.unlock, lock, testChecker)
+			if test.want == nil && err != nil || test.want != nil && !errors.Is(err, test.want) {
+				t.Errorf("VerifyScript = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestTransactionSignatures(t *testing.T) {
+	chain, alice := newTestChain(t)
+	utxo := UTXOSet{chain}
+	bob := wallet.MakeWallet()
+	tx := NewTransaction(alice, string(bob.Address()), 5, 0, 0, &utxo)
+	if !chain.VerifyTransaction(tx) {
+		t.Fatal("a signed transaction does not verify")
+	}
+
+	tampered := *tx
+	tampered.Outputs = append([]TxOutput{}, tx.Outputs...)
+	tampered.Outputs[0].Value++
+	tampered.ID = tampered.Hash()
+	if chain.VerifyTransaction(&tampered) {
+		t.Error("a transaction changed after signing verifies")
+	}
+
+	// The same payment signed by bob, who does not own the outputs.
+	stolen := *tx
+	stolen.Inputs = append([]TxInput{}, tx.Inputs...)
+	prevTXs, err := chain.previousTransactions(&stolen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stolen.Sign(bob.PrivateKey, prevTXs)
+	stolen.ID = stolen.Hash()
+	if chain.VerifyTransaction(&stolen) {
+		t.Error("a transaction signed by another key verifies")
+	}
+	if _, err := tryMine(chain, string(bob.Address()), &stolen); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("mining it = %v, want %v", err, ErrBadSignature)
+	}
+}
+
+func TestVerifyMultisigScript(t *testing.T) {
+	keys := [][]byte{[]byte("key 1"), []byte("key 2"), []byte("key 3")}
+	redeem, err := MultisigScript(2, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, parsed, ok := ParseMultisigScript(redeem)
+	if !ok || m != 2 || len(parsed) != len(keys) {
+		t.Fatalf("ParseMultisigScript(%s) = %d, %d keys, %v", DisassembleScript(redeem), m, len(parsed), ok)
+	}
+	lock := P2SHScript(wallet.PublicKeyHash(redeem))
+	if !bytes.Equal(ExtractScriptHash(lock), wallet.PublicKeyHash(redeem)) {
+		t.Fatalf("ExtractScriptHash(%s) does not return the hash", DisassembleScript(lock))
+	}
+
+	tests := []struct {
+		name  string
+		sigs  [][]byte
+		valid bool
+	}{
+		{"first two keys", [][]byte{fakeSig(keys[0]), fakeSig(keys[1])}, true},
+		{"outer keys", [][]byte{fakeSig(keys[0]), fakeSig(keys[2])}, true},
+		{"out of order", [][]byte{fakeSig(keys[2]), fakeSig(keys[0])}, false},
+		{"one signature", [][]byte{fakeSig(keys[1])}, false},
+		{"same key twice", [][]byte{fakeSig(keys[1]), fakeSig(keys[1])}, false},
+		{"foreign key", [][]byte{fakeSig(keys[0]), fakeSig([]byte("key 4"))}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := VerifyScript(MultisigUnlockScript(test.sigs, redeem), lock, testChecker)
+			if test.valid != (err == nil) {
+				t.Errorf("VerifyScript = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+
+	other, err := MultisigScript(1, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock := MultisigUnlockScript([][]byte{fakeSig(keys[0])}, other)
+	if err := VerifyScript(unlock, lock, testChecker); err == nil {
+		t.Error("a different redeem script unlocked the output")
+	}
+}
+
+func TestMultisigScriptLimits(t *testing.T) {
+	keys := make([][]byte, MaxMultisigKeys+1)
+	for i := range keys {
+		keys[i] = []byte{byte(i)}
+	}
+	for _, test := range []struct {
+		m, n int
+	}{{0, 1}, {2, 1}, {1, 0}, {1, MaxMultisigKeys + 1}} {
+		if _, err := MultisigScript(test.m, keys[:test.n]); err == nil {
+			t.Errorf("MultisigScript(%d of %d) succeeded", test.m, test.n)
+		}
+	}
+}
+
+func TestSpendMultisigOutput(t *testing.T) {
+	chain, alice := newTestChain(t)
+	utxo := UTXOSet{chain}
+	signers := []*wallet.Wallet{wallet.MakeWallet(), wallet.MakeWallet(), wallet.MakeWallet()}
+	var pubKeys [][]byte
+	for _, w := range signers {
+		pubKeys = append(pubKeys, w.PublicKey)
+	}
+	redeem, err := MultisigScript(2, pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := &wallet.Multisig{Required: 2, PublicKeys: pubKeys, RedeemScript: redeem}
+	mineTxs(t, chain, string(alice.Address()), NewTransaction(alice, string(ms.Address()), 10, 0, 0, &utxo))
+
+	bob := wallet.MakeWallet()
+	stranger := wallet.MakeWallet()
+	bad := NewMultisigTransaction(ms, []*wallet.Wallet{signers[0], stranger}, string(bob.Address()), 4, 1, 0, &utxo)
+	if _, err := tryMine(chain, string(alice.Address()), bad); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("mining a spend signed by a stranger = %v, want %v", err, ErrBadSignature)
+	}
+
+	good := NewMultisigTransaction(ms, signers[1:], string(bob.Address()), 4, 1, 0, &utxo)
+	mineTxs(t, chain, string(alice.Address()), good)
+	if got := balance(chain, bob); got != 4 {
+		t.Errorf("bob has %d, want 4", got)
+	}
+	spendable, _ := utxo.Balance(wallet.PublicKeyHash(redeem))
+	if spendable != 5 {
+		t.Errorf("the multisig address has %d, want 5", spendable)
+	}
+}
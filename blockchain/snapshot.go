@@ -0,0 +1,515 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"sync"
+)
+
+// A UTXO snapshot file lets a node start from the UTXO set at a block
+// instead of replaying every block before it. It is encoded as described in
+// encoding.go:
+//
+//	magic       8 bytes, "gobcutxo"
+//	engine      bytes, the authority keys of a proof-of-authority chain
+//	headers     uint32 count, then per block from the genesis block to the
+//	              base block: its header and signature bytes, as bytes
+//	outputs     uint32 count, then per transaction: txid bytes, outputs
+//	              bytes as in TxOutputs.Serialize
+//	commitment  32 bytes, the snapshot hash
+//
+// The snapshot hash is the SHA-256 of the base block hash, its height as a
+// uint64 and every txid and outputs pair as bytes, in txid order.
+const snapshotMagic = "gobcutxo"
+
+// snapshotKey marks a chain loaded from a snapshot whose history has not yet
+// been validated. It holds the snapshot being checked.
+var snapshotKey = []byte("snapshot")
+
+// historyFailedKey marks a chain loaded from a snapshot that its history
+// did not lead to. It holds the reason.
+var historyFailedKey = []byte("historyfailed")
+
+var (
+	ErrSnapshotHash    = errors.New("UTXO snapshot does not match its hash")
+	ErrSnapshotHeaders = errors.New("UTXO snapshot header chain is invalid")
+	ErrSnapshotHistory = errors.New("block history does not lead to the UTXO snapshot")
+)
+
+// Snapshot identifies the UTXO set at the block BaseHash.
+type Snapshot struct {
+	BaseHash []byte
+	Height   int
+	Hash     []byte
+}
+
+func (s Snapshot) Serialize() []byte {
+	data := appendBytes(nil, s.BaseHash)
+	data = appendUint64(data, uint64(s.Height))
+	return appendBytes(data, s.Hash)
+}
+
+func DeserializeSnapshot(data []byte) Snapshot {
+	r := &reader{data: data}
+	s := Snapshot{BaseHash: r.bytes(), Height: int(r.uint64()), Hash: r.bytes()}
+	HandleError(r.finish())
+	return s
+}
+
+func newSnapshotHash(baseHash []byte, height int) hash.Hash {
+	h := sha256.New()
+	h.Write(fixedHash(baseHash))
+	h.Write(appendUint64(nil, uint64(height)))
+	return h
+}
+
+// DumpUTXO writes the UTXO set at the tip, with the header chain leading to
+// it, to path and returns the snapshot written.
+func (bc *BlockChain) DumpUTXO(path string) (Snapshot, error) {
+	var snapshot Snapshot
+	data := []byte(snapshotMagic)
+	err := bc.Database.View(func(txn Txn) error {
+		lastHash, err := getLastHash(txn)
+		if err != nil {
+			return err
+		}
+		tip, err := getBlock(txn, lastHash)
+		if err != nil {
+			return err
+		}
+		headers := make([][]byte, tip.Height+1)
+		for block := tip; ; {
+			headers[block.Height] = appendBytes(block.BlockHeader.Serialize(), block.Signature)
+			if len(block.PrevHash) == 0 {
+				break
+			}
+			if block, err = getBlock(txn, block.PrevHash); err != nil {
+				return err
+			}
+		}
+		data = appendBytes(data, encodeEngine(bc.Engine))
+		data = appendUint32(data, uint32(len(headers)))
+		for _, header := range headers {
+			data = appendBytes(data, header)
+		}
+
+		h := newSnapshotHash(tip.Hash, tip.Height)
+		var outputs []byte
+		count := 0
+		err = txn.Scan(utxoPrefix, func(k, v []byte) error {
+			entry := appendBytes(nil, k[len(utxoPrefix):])
+			entry = appendBytes(entry, v)
+			h.Write(entry)
+			outputs = append(outputs, entry...)
+			count++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		data = appendUint32(data, uint32(count))
+		data = append(data, outputs...)
+
+		snapshot = Snapshot{BaseHash: tip.Hash, Height: tip.Height, Hash: h.Sum(nil)}
+		data = append(data, snapshot.Hash...)
+		return nil
+	})
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return snapshot, os.WriteFile(path, data, 0644)
+}
+
+// LoadUTXO creates the chain of node nodeId from the snapshot file at path.
+// The header chain is validated and stored without transactions, the UTXO
+// set and the unspent part of the address index are filled in, and the base
+// block becomes the tip. If expected is not empty the snapshot hash must
+// equal it. StartHistoryValidation later checks the snapshot against the
+// full blocks.
+func LoadUTXO(path, nodeId string, expected []byte) (*BlockChain, Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, Snapshot{}, err
+	}
+	dbDir := fmt.Sprintf(Params.DBPath, nodeId)
+	if DBExists(dbDir) {
+		return nil, Snapshot{}, fmt.Errorf("blockchain already exists at %s", dbDir)
+	}
+	if !bytes.HasPrefix(data, []byte(snapshotMagic)) || len(data) < len(snapshotMagic)+sha256.Size {
+		return nil, Snapshot{}, ErrMalformedEncoding
+	}
+	commitment := data[len(data)-sha256.Size:]
+	if len(expected) > 0 && !bytes.Equal(commitment, expected) {
+		return nil, Snapshot{}, fmt.Errorf("%w: hash is %x, expected %x", ErrSnapshotHash, commitment, expected)
+	}
+
+	r := &reader{data: data[len(snapshotMagic) : len(data)-sha256.Size]}
+	engine, err := decodeEngine(r.bytes())
+	if err != nil {
+		return nil, Snapshot{}, err
+	}
+	var headers []*Block
+	for i, count := 0, r.count(4); i < count; i++ {
+		headerReader := &reader{data: r.bytes()}
+		header := &Block{BlockHeader: readHeader(headerReader), Signature: headerReader.bytes()}
+		if err := headerReader.finish(); err != nil && r.err == nil {
+			r.err = err
+		}
+		header.Hash = header.BlockHeader.Hash()
+		headers = append(headers, header)
+	}
+	if r.err == nil && len(headers) == 0 {
+		r.err = ErrMalformedEncoding
+	}
+	base := &Block{}
+	if len(headers) > 0 {
+		base = headers[len(headers)-1]
+	}
+	h := newSnapshotHash(base.Hash, base.Height)
+	var entries [][2][]byte
+	for i, count := 0, r.count(8); i < count; i++ {
+		txID, outs := r.bytes(), r.bytes()
+		h.Write(appendBytes(appendBytes(nil, txID), outs))
+		entries = append(entries, [2][]byte{txID, outs})
+	}
+	if err := r.finish(); err != nil {
+		return nil, Snapshot{}, err
+	}
+	snapshot := Snapshot{BaseHash: base.Hash, Height: base.Height, Hash: h.Sum(nil)}
+	if !bytes.Equal(snapshot.Hash, commitment) {
+		return nil, Snapshot{}, ErrSnapshotHash
+	}
+
+	db, err := OpenBadger(dbDir)
+	if err != nil {
+		return nil, Snapshot{}, err
+	}
+	bc := &BlockChain{Database: db, Engine: engine}
+	if err := bc.loadSnapshot(headers, entries, snapshot); err != nil {
+		db.Close()
+		os.RemoveAll(dbDir)
+		return nil, Snapshot{}, err
+	}
+	bc.LastHash = base.Hash
+	return bc, snapshot, nil
+}
+
+// loadSnapshot fills the empty database of bc from the parts of a snapshot
+// file.
+func (bc *BlockChain) loadSnapshot(headers []*Block, entries [][2][]byte, snapshot Snapshot) error {
+	if err := bc.loadHeaders(headers); err != nil {
+		return err
+	}
+
+	wb := bc.Database.NewWriteBatch()
+	defer wb.Cancel()
+	for _, entry := range entries {
+		txID := entry[0]
+		outs, err := DecodeOutputs(entry[1])
+		if err != nil {
+			return fmt.Errorf("outputs of transaction %x: %w", txID, err)
+		}
+		if err := wb.Set(prefixedKey(utxoPrefix, txID), entry[1]); err != nil {
+			return err
+		}
+		for i, outIdx := range outs.Indexes {
+			out := outs.Outputs[i]
+			if out.PubKeyHash() == nil {
+				continue
+			}
+			if err := wb.Set(addrUTXOKey(out.PubKeyHash(), txID, outIdx), out.Serialize()); err != nil {
+				return err
+			}
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+
+	// The blocks up to the base have no transactions or undo data, like
+	// pruned blocks, until history validation fetches them.
+	return bc.Database.Update(func(txn Txn) error {
+		if err := txn.Set(snapshotKey, snapshot.Serialize()); err != nil {
+			return err
+		}
+		if err := putEngine(txn, bc.Engine); err != nil {
+			return err
+		}
+		if err := txn.Set(chainVersionKey, ToHex(ChainVersion)); err != nil {
+			return err
+		}
+		return txn.Set(prunedHeightKey, appendUint64(nil, uint64(snapshot.Height)))
+	})
+}
+
+// loadHeaders validates and stores the header chain of a snapshot, making
+// the last header the tip.
+func (bc *BlockChain) loadHeaders(headers []*Block) error {
+	for _, header := range headers {
+		err := bc.Database.Update(func(txn Txn) error {
+			if err := checkHeaderFields(header); err != nil {
+				return fmt.Errorf("%w: %w", ErrSnapshotHeaders, err)
+			}
+			if err := bc.Engine.VerifySeal(header); err != nil {
+				return fmt.Errorf("%w: block %d: %w", ErrSnapshotHeaders, header.Height, err)
+			}
+			work := bc.Engine.Work(header)
+			if header.Height == 0 {
+				if len(header.PrevHash) != 0 {
+					return fmt.Errorf("%w: first block is not a genesis block", ErrSnapshotHeaders)
+				}
+			} else {
+				if err := checkBlockContext(txn, header); err != nil {
+					return fmt.Errorf("%w: %w", ErrSnapshotHeaders, err)
+				}
+				parentWork, err := getChainWork(txn, header.PrevHash)
+				if err != nil {
+					return err
+				}
+				work.Add(work, parentWork)
+			}
+			if err := txn.Set(header.Hash, header.Serialize()); err != nil {
+				return err
+			}
+			if err := setChainWork(txn, header.Hash, work); err != nil {
+				return err
+			}
+			return txn.Set([]byte("lh"), header.Hash)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getSnapshot(txn Txn) (*Snapshot, error) {
+	v, err := txn.Get(snapshotKey)
+	if err == ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	snapshot := DeserializeSnapshot(v)
+	return &snapshot, nil
+}
+
+// PendingSnapshot returns the snapshot the chain was loaded from if its
+// history has not been validated yet, or nil.
+func (bc *BlockChain) PendingSnapshot() *Snapshot {
+	var snapshot *Snapshot
+	err := bc.Database.View(func(txn Txn) error {
+		var err error
+		snapshot, err = getSnapshot(txn)
+		return err
+	})
+	HandleError(err)
+	return snapshot
+}
+
+// NeedsBlock reports whether the node wants the block with the given hash:
+// it is unknown, or its transactions are missing and history validation
+// needs them.
+func (bc *BlockChain) NeedsBlock(hash []byte) bool {
+	block, err := bc.GetBlock(hash)
+	if err != nil {
+		return true
+	}
+	return block.Pruned() && bc.PendingSnapshot() != nil
+}
+
+// wantsHistoricalBlock reports whether block is one of the blocks below a
+// pending snapshot that is stored without its transactions.
+func (bc *BlockChain) wantsHistoricalBlock(block *Block) bool {
+	stored, err := bc.GetBlock(block.Hash)
+	return err == nil && stored.Pruned() && !block.Pruned() && bc.PendingSnapshot() != nil
+}
+
+// addHistoricalBlock stores the transactions of a checked block below a
+// pending snapshot and wakes history validation.
+func (bc *BlockChain) addHistoricalBlock(block *Block) error {
+	err := bc.Database.Update(func(txn Txn) error {
+		return txn.Set(block.Hash, block.Serialize())
+	})
+	if err != nil {
+		return err
+	}
+	if bc.history != nil {
+		select {
+		case bc.history.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// historyValidator replays the full blocks below a snapshot into a separate
+// database and compares the resulting UTXO set with the snapshot.
+type historyValidator struct {
+	path     string
+	wake     chan struct{}
+	chain    *BlockChain
+	hashes   [][]byte
+	snapshot *Snapshot
+	mu       sync.Mutex
+}
+
+// StartHistoryValidation starts validating, in the background, the blocks
+// below the snapshot the chain was loaded from, as their transactions
+// arrive. The returned channel is closed once the snapshot is confirmed, or
+// receives the error validation stopped with; the UTXO set cannot be
+// trusted after an error. It returns nil if there is no pending snapshot.
+func (bc *BlockChain) StartHistoryValidation(nodeId string) <-chan error {
+	snapshot := bc.PendingSnapshot()
+	if snapshot == nil {
+		return nil
+	}
+	hashes := make([][]byte, snapshot.Height+1)
+	err := bc.Database.View(func(txn Txn) error {
+		for hash := snapshot.BaseHash; len(hash) > 0; {
+			block, err := getBlock(txn, hash)
+			if err != nil {
+				return err
+			}
+			hashes[block.Height] = block.Hash
+			hash = block.PrevHash
+		}
+		return nil
+	})
+	HandleError(err)
+
+	bc.history = &historyValidator{
+		path:     fmt.Sprintf(Params.DBPath, nodeId+"_history"),
+		wake:     make(chan struct{}, 1),
+		hashes:   hashes,
+		snapshot: snapshot,
+	}
+	bc.history.wake <- struct{}{}
+	result := make(chan error, 1)
+	go func() {
+		defer close(result)
+		for range bc.history.wake {
+			done, err := bc.validateHistory()
+			if err != nil {
+				result <- bc.failHistory(err)
+				return
+			}
+			if done {
+				return
+			}
+		}
+	}()
+	return result
+}
+
+// validateHistory connects the blocks whose transactions have arrived, in
+// order, and reports whether the snapshot base has been reached and found
+// to match.
+func (bc *BlockChain) validateHistory() (bool, error) {
+	v := bc.history
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	next := 0
+	if v.chain != nil {
+		next = v.chain.GetBestHeight() + 1
+	}
+	for ; next <= v.snapshot.Height; next++ {
+		block, err := bc.GetBlock(v.hashes[next])
+		if err != nil {
+			return false, err
+		}
+		if block.Pruned() {
+			return false, nil
+		}
+		if next == 0 {
+			if v.chain, err = newHistoryChain(v.path, &block, bc.Engine); err != nil {
+				return false, err
+			}
+			continue
+		}
+		if err := v.chain.AddBlock(&block); err != nil {
+			return false, err
+		}
+	}
+
+	var hash []byte
+	err := v.chain.Database.View(func(txn Txn) error {
+		h := newSnapshotHash(v.snapshot.BaseHash, v.snapshot.Height)
+		err := txn.Scan(utxoPrefix, func(k, val []byte) error {
+			h.Write(appendBytes(appendBytes(nil, k[len(utxoPrefix):]), val))
+			return nil
+		})
+		hash = h.Sum(nil)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(hash, v.snapshot.Hash) {
+		return false, fmt.Errorf("%w: replayed UTXO set hash is %x, snapshot %x", ErrSnapshotHistory, hash, v.snapshot.Hash)
+	}
+
+	v.chain.Database.Close()
+	os.RemoveAll(v.path)
+	err = bc.Database.Update(func(txn Txn) error {
+		return txn.Delete(snapshotKey)
+	})
+	if err != nil {
+		return false, err
+	}
+	fmt.Printf("History validated up to the snapshot at height %d (%s)\n", v.snapshot.Height, hex.EncodeToString(v.snapshot.BaseHash))
+	return true, nil
+}
+
+// failHistory stops history validation after err and returns the error to
+// report. A block that is invalid, or a history that does not lead to the
+// snapshot, proves the snapshot wrong, and is recorded so the chain is
+// never loaded again. Other errors leave the snapshot pending, to be
+// validated again on the next start.
+func (bc *BlockChain) failHistory(err error) error {
+	if bc.history.chain != nil {
+		bc.history.chain.Database.Close()
+	}
+	var blockErr *BlockError
+	if !errors.As(err, &blockErr) && !errors.Is(err, ErrSnapshotHistory) {
+		return err
+	}
+	dbErr := bc.Database.Update(func(txn Txn) error {
+		return txn.Set(historyFailedKey, []byte(err.Error()))
+	})
+	if dbErr != nil {
+		return fmt.Errorf("%w (recording it: %w)", err, dbErr)
+	}
+	return err
+}
+
+// newHistoryChain creates the database history validation replays blocks
+// into, starting from genesis.
+func newHistoryChain(path string, genesis *Block, engine Engine) (*BlockChain, error) {
+	os.RemoveAll(path)
+	db, err := OpenBadger(path)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := createBlockChain(db, genesis, engine, false)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	err = chain.Database.Update(func(txn Txn) error {
+		utxo := UTXOSet{chain}
+		return utxo.connect(txn, genesis)
+	})
+	if err != nil {
+		chain.Database.Close()
+		return nil, err
+	}
+	return chain, nil
+}
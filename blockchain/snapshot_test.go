@@ -0,0 +1,47 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSnapshotHeadersOutOfRange(t *testing.T) {
+	genesis := &Block{BlockHeader: BlockHeader{Version: BlockVersion, Difficulty: 300}}
+	genesis.Hash = genesis.BlockHeader.Hash()
+	chain := &BlockChain{Database: NewMemoryStorage(), Engine: PoWEngine{}}
+	if err := chain.loadHeaders([]*Block{genesis}); !errors.Is(err, ErrSnapshotHeaders) {
+		t.Errorf("loadHeaders = %v, want %v", err, ErrSnapshotHeaders)
+	}
+}
+
+func TestSnapshotMalformedOutputs(t *testing.T) {
+	source, _ := newTestChain(t)
+	genesis := tip(t, source)
+	chain := &BlockChain{Database: NewMemoryStorage(), Engine: PoWEngine{}}
+	entries := [][2][]byte{{genesis.Transactions[0].ID, []byte("not outputs")}}
+	snapshot := Snapshot{BaseHash: genesis.Hash}
+	if err := chain.loadSnapshot([]*Block{genesis}, entries, snapshot); !errors.Is(err, ErrMalformedEncoding) {
+		t.Errorf("loadSnapshot = %v, want %v", err, ErrMalformedEncoding)
+	}
+}
+
+func TestFailHistoryRecordsInvalidHistory(t *testing.T) {
+	chain, _ := newTestChain(t)
+	chain.history = &historyValidator{}
+
+	diskErr := errors.New("disk failed")
+	if err := chain.failHistory(diskErr); err != diskErr {
+		t.Fatalf("failHistory = %v, want %v", err, diskErr)
+	}
+	if _, err := LoadBlockChain(chain.Database); err != nil {
+		t.Fatalf("the chain does not load after a storage error: %v", err)
+	}
+
+	invalid := blockError(tip(t, chain), ErrBadSignature)
+	if err := chain.failHistory(invalid); err != invalid {
+		t.Fatalf("failHistory = %v, want %v", err, invalid)
+	}
+	if _, err := LoadBlockChain(chain.Database); !errors.Is(err, ErrSnapshotHistory) {
+		t.Errorf("LoadBlockChain after an invalid block = %v, want %v", err, ErrSnapshotHistory)
+	}
+}
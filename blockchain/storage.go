@@ -0,0 +1,43 @@
+package blockchain
+
+import "errors"
+
+// ErrKeyNotFound is returned by Txn.Get for keys that are not stored.
+var ErrKeyNotFound = errors.New("key not found")
+
+// errStopScan is returned by Scan callbacks that need no more keys.
+var errStopScan = errors.New("scan stopped")
+
+// Storage is the key-value store holding a chain: its blocks, the UTXO set
+// and the indexes. Badger is used for nodes, see OpenBadger, and
+// MemoryStorage for tests and simulations.
+type Storage interface {
+	// View runs fn in a read-only transaction.
+	View(fn func(txn Txn) error) error
+	// Update runs fn in a read-write transaction, which is committed if fn
+	// returns nil and discarded otherwise.
+	Update(fn func(txn Txn) error) error
+	// NewWriteBatch starts a batch of writes too large for one transaction.
+	NewWriteBatch() WriteBatch
+	Close() error
+}
+
+// Txn is a transaction on a Storage. It sees its own writes.
+type Txn interface {
+	// Get returns a copy of the value stored at key, or ErrKeyNotFound.
+	Get(key []byte) ([]byte, error)
+	Set(key, value []byte) error
+	Delete(key []byte) error
+	// Scan calls fn with copies of every key starting with prefix and its
+	// value, in key order, stopping at the first error fn returns.
+	Scan(prefix []byte, fn func(key, value []byte) error) error
+}
+
+// WriteBatch writes keys that are only visible once Flush returns. The
+// writes are not atomic: a failed Flush may leave some of them stored.
+type WriteBatch interface {
+	Set(key, value []byte) error
+	Flush() error
+	// Cancel drops the writes not yet flushed.
+	Cancel()
+}
@@ -0,0 +1,101 @@
+package blockchain
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// medianTimeBlocks is the number of blocks whose timestamps make up the
+	// median time past.
+	medianTimeBlocks = 11
+	// maxTimeOffset bounds how far peers may move the adjusted clock from
+	// the local one, in seconds.
+	maxTimeOffset = 70 * 60
+	// maxTimeSamples bounds the number of peers whose clocks are kept.
+	maxTimeSamples = 200
+)
+
+// medianTimePast returns the median timestamp of block and the ancestors
+// before it, up to medianTimeBlocks blocks. A new block on top of block must
+// be timestamped after it.
+func medianTimePast(txn Txn, block *Block) (int64, error) {
+	var timestamps []int64
+	for {
+		timestamps = append(timestamps, block.Timestamp)
+		if len(timestamps) == medianTimeBlocks || len(block.PrevHash) == 0 {
+			break
+		}
+		var err error
+		if block, err = getBlock(txn, block.PrevHash); err != nil {
+			return 0, err
+		}
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2], nil
+}
+
+// MedianTimePast returns the median time past of the tip.
+func (bc *BlockChain) MedianTimePast() int64 {
+	var mtp int64
+	err := bc.Database.View(func(txn Txn) error {
+		lastHash, err := getLastHash(txn)
+		if err != nil {
+			return err
+		}
+		tip, err := getBlock(txn, lastHash)
+		if err != nil {
+			return err
+		}
+		mtp, err = medianTimePast(txn, tip)
+		return err
+	})
+	HandleError(err)
+	return mtp
+}
+
+// The adjusted clock is the local clock moved by the median of the offsets
+// reported by peers in their version messages, our own zero offset included.
+var timeOffsets = struct {
+	sync.Mutex
+	peers map[string]int64
+}{peers: make(map[string]int64)}
+
+// AddTimeSample records the clock of peer, as sent in its version message.
+// peer must be the address the message came from, not one the peer claims,
+// so that a peer cannot outvote the others. Only the first sample of each
+// peer and the first maxTimeSamples peers count.
+func AddTimeSample(peer string, peerTime int64) {
+	timeOffsets.Lock()
+	defer timeOffsets.Unlock()
+	if _, ok := timeOffsets.peers[peer]; ok || len(timeOffsets.peers) >= maxTimeSamples {
+		return
+	}
+	timeOffsets.peers[peer] = peerTime - time.Now().Unix()
+}
+
+// TimeOffset returns the number of seconds the adjusted clock is ahead of
+// the local one. Offsets beyond maxTimeOffset are ignored, since the local
+// clock is more likely right than peers that far off.
+func TimeOffset() int64 {
+	timeOffsets.Lock()
+	defer timeOffsets.Unlock()
+	offsets := []int64{0}
+	for _, offset := range timeOffsets.peers {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	median := offsets[len(offsets)/2]
+	if median > maxTimeOffset || median < -maxTimeOffset {
+		fmt.Printf("Peer clocks are %d seconds off ours, check the local clock\n", median)
+		return 0
+	}
+	return median
+}
+
+// AdjustedTime returns the network-adjusted current time in Unix seconds.
+func AdjustedTime() int64 {
+	return time.Now().Unix() + TimeOffset()
+}
@@ -6,7 +6,6 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
 	"fmt"
 	"log"
@@ -16,30 +15,77 @@ import (
 	"github.com/nthskyradiated/go-bc/wallet"
 )
 
+const (
+	// LockTimeThreshold separates lock times that are block heights (below
+	// it) from Unix timestamps (at or above it).
+	LockTimeThreshold = 500000000
+	// SequenceFinal marks an input that does not enable the lock time.
+	SequenceFinal = 0xffffffff
+)
+
+// A transaction with a non-zero LockTime may only be mined in a block whose
+// height, or timestamp, is past it.
 type Transaction struct {
-	ID      []byte
-	Inputs  []TxInput
-	Outputs []TxOutput
+	ID       []byte
+	Inputs   []TxInput
+	Outputs  []TxOutput
+	LockTime uint32
 }
 
-func (tx Transaction) Serialize() []byte{
-	var encoded bytes.Buffer
-	encode := gob.NewEncoder(&encoded)
-	err := encode.Encode(tx)
-	if err != nil {
-		log.Panicf("Failed to serialize transaction: %v", err)
+// Serialize returns the canonical encoding of the transaction, described in
+// encoding.go. It does not include the ID.
+func (tx Transaction) Serialize() []byte {
+	b := appendUint32(nil, TxVersion)
+	b = appendUint32(b, uint32(len(tx.Inputs)))
+	for _, in := range tx.Inputs {
+		b = appendBytes(b, in.ID)
+		b = appendUint32(b, uint32(int32(in.OutIndex)))
+		b = appendBytes(b, in.ScriptSig)
+		b = appendUint32(b, in.Sequence)
+	}
+	b = appendUint32(b, uint32(len(tx.Outputs)))
+	for _, out := range tx.Outputs {
+		b = out.appendTo(b)
 	}
-	return encoded.Bytes()
+	return appendUint32(b, tx.LockTime)
 }
 
+// Hash returns the SHA-256 of the serialized transaction, which is its ID.
 func (tx *Transaction) Hash() []byte {
-	var hash [32]byte
-	txCopy := *tx
-	txCopy.ID = nil // Clear the ID to avoid using it in the hash
-	hash = sha256.Sum256(txCopy.Serialize())
+	hash := sha256.Sum256(tx.Serialize())
 	return hash[:]
 }
 
+// OutputValue returns the total value of the transaction's outputs.
+func (tx *Transaction) OutputValue() int {
+	total := 0
+	for _, out := range tx.Outputs {
+		total += out.Value
+	}
+	return total
+}
+
+// IsFinal reports whether tx may be included in a block at height with the
+// given timestamp.
+func (tx *Transaction) IsFinal(height int, timestamp int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+	limit := int64(height)
+	if tx.LockTime >= LockTimeThreshold {
+		limit = timestamp
+	}
+	if int64(tx.LockTime) < limit {
+		return true
+	}
+	for _, in := range tx.Inputs {
+		if in.Sequence != SequenceFinal {
+			return false
+		}
+	}
+	return true
+}
+
 func (tx *Transaction) IsCoinbase() bool {
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].OutIndex == -1
 }
@@ -54,35 +100,78 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
 			log.Panicf("Previous transaction not found: %x", input.ID)
 		}
 	}
-	txCopy := tx.TrimmedCopy()
+	pubKey := elliptic.Marshal(privKey.Curve, privKey.X, privKey.Y)
 
-	for i, input := range txCopy.Inputs {
+	for i, input := range tx.Inputs {
 		prevTX := prevTXs[hex.EncodeToString(input.ID)]
-		txCopy.Inputs[i].Sig = nil // Clear the signature for signing
-		txCopy.Inputs[i].PubKey = prevTX.Outputs[input.OutIndex].ScriptPubKey
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[i].PubKey = nil
+		hash := tx.SigHash(i, prevTX.Outputs[input.OutIndex].ScriptPubKey)
 
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
+		r, s, err := ecdsa.Sign(rand.Reader, &privKey, hash)
 		HandleError(err)
-		signature := append(r.Bytes(), s.Bytes()...)
-		tx.Inputs[i].Sig = signature
+		// r and s are padded to the curve size so Verify can split them.
+		signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		tx.Inputs[i].ScriptSig = P2PKHUnlockScript(signature, pubKey)
+	}
+}
+
+// SignMultisig signs every input spending a P2SH output locked to
+// redeemScript, a multisig script. privKeys must hold at least the required
+// number of its keys, in the order the keys appear in the script.
+func (tx *Transaction) SignMultisig(privKeys []ecdsa.PrivateKey, redeemScript []byte, prevTXs map[string]Transaction) {
+	m, _, ok := ParseMultisigScript(redeemScript)
+	if !ok {
+		log.Panic("Redeem script is not a multisig script")
+	}
+	if len(privKeys) < m {
+		log.Panicf("Not enough keys to sign: %d < %d", len(privKeys), m)
+	}
+	scriptHash := wallet.PublicKeyHash(redeemScript)
+
+	for i, input := range tx.Inputs {
+		prevTX, ok := prevTXs[hex.EncodeToString(input.ID)]
+		if !ok {
+			log.Panicf("Previous transaction not found: %x", input.ID)
+		}
+		prevScript := prevTX.Outputs[input.OutIndex].ScriptPubKey
+		if !bytes.Equal(ExtractScriptHash(prevScript), scriptHash) {
+			continue
+		}
+		hash := tx.SigHash(i, prevScript)
+
+		var sigs [][]byte
+		for _, privKey := range privKeys[:m] {
+			r, s, err := ecdsa.Sign(rand.Reader, &privKey, hash)
+			HandleError(err)
+			sigs = append(sigs, append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...))
+		}
+		tx.Inputs[i].ScriptSig = MultisigUnlockScript(sigs, redeemScript)
 	}
 }
 
+// SigHash is the hash signed for input i. It covers the transaction with
+// every unlocking script cleared and input i's replaced by the locking
+// script of the output it spends.
+func (tx *Transaction) SigHash(i int, prevScript []byte) []byte {
+	txCopy := tx.TrimmedCopy()
+	txCopy.Inputs[i].ScriptSig = prevScript
+	return txCopy.Hash()
+}
+
 func (tx *Transaction) TrimmedCopy() Transaction {
 	var outputs []TxOutput
 	var inputs []TxInput
 	for _, in := range tx.Inputs {
-		inputs = append(inputs, TxInput{in.ID, in.OutIndex, nil, nil})
+		inputs = append(inputs, TxInput{in.ID, in.OutIndex, nil, in.Sequence})
 	}
 	for _, out := range tx.Outputs {
 		outputs = append(outputs, TxOutput{out.Value, out.ScriptPubKey})
 	}
-	txCopy := Transaction{ tx.ID, inputs, outputs }
+	txCopy := Transaction{ tx.ID, inputs, outputs, tx.LockTime }
 	return txCopy
 }
 
+// Verify runs every input's unlocking script against the locking script of
+// the output it spends.
 func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	if tx.IsCoinbase() {
 		return true
@@ -94,72 +183,134 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 		}
 	}
 
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
 	for i, input := range tx.Inputs {
 		prevTX := prevTXs[hex.EncodeToString(input.ID)]
-		txCopy.Inputs[i].Sig = nil // Clear the signature for verification
-		txCopy.Inputs[i].PubKey = prevTX.Outputs[input.OutIndex].ScriptPubKey
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[i].PubKey = nil
+		prevScript := prevTX.Outputs[input.OutIndex].ScriptPubKey
+		hash := tx.SigHash(i, prevScript)
+		if err := VerifyScript(input.ScriptSig, prevScript, func(sig, pubKey []byte) bool {
+			return checkSignature(hash, sig, pubKey)
+		}); err != nil {
+			return false
+		}
+	}
+	return true
+}
 
-		r := new(big.Int).SetBytes(input.Sig[:len(input.Sig)/2])
-		s := new(big.Int).SetBytes(input.Sig[len(input.Sig)/2:])
+// checkSignature verifies an r||s signature over hash by the marshalled
+// public key pubKey.
+func checkSignature(hash, sig, pubKey []byte) bool {
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, pubKey)
+	if x == nil || len(sig) != 64 {
+		return false
+	}
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
 
+	rawPubKey := ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	return ecdsa.Verify(&rawPubKey, hash, r, s)
+}
 
-		x := new(big.Int).SetBytes(input.PubKey[:len(input.PubKey)/2])
-		y := new(big.Int).SetBytes(input.PubKey[len(input.PubKey)/2:])
+func DeserializeTransaction(data []byte) Transaction {
+	tx, err := DecodeTransaction(data)
+	HandleError(err)
+	return tx
+}
 
-		rawPubKey := ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+// DecodeTransaction is DeserializeTransaction for data that may be malformed.
+func DecodeTransaction(data []byte) (Transaction, error) {
+	r := &reader{data: data}
+	tx := readTransaction(r)
+	return tx, r.finish()
+}
 
-		if !ecdsa.Verify(&rawPubKey, txCopy.ID, r, s) {
-			return false
-		}
+// readTransaction decodes a transaction and sets its ID.
+func readTransaction(r *reader) Transaction {
+	var tx Transaction
+	if version := r.uint32(); r.err == nil && version != TxVersion {
+		r.err = fmt.Errorf("unsupported transaction version %d", version)
 	}
-	return true
+	inputs := r.count(16)
+	for i := 0; i < inputs; i++ {
+		var in TxInput
+		in.ID = r.bytes()
+		in.OutIndex = int(int32(r.uint32()))
+		in.ScriptSig = r.bytes()
+		in.Sequence = r.uint32()
+		tx.Inputs = append(tx.Inputs, in)
+	}
+	outputs := r.count(12)
+	for i := 0; i < outputs; i++ {
+		tx.Outputs = append(tx.Outputs, readOutput(r))
+	}
+	tx.LockTime = r.uint32()
+	if r.err == nil {
+		tx.ID = tx.Hash()
+	}
+	return tx
 }
 
-func DeserializeTransaction(data []byte) Transaction {
-	var transaction Transaction
+// NewTransaction pays amount from w to to, leaving fee to the miner. A
+// non-zero lockTime keeps the transaction out of blocks until that height or
+// Unix time.
+func NewTransaction(w *wallet.Wallet, to string, amount, fee int, lockTime uint32, UTXO *UTXOSet) *Transaction {
+	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+	tx := newSpend(pubKeyHash, string(w.Address()), to, amount, fee, lockTime, UTXO)
+	UTXO.Blockchain.SignTransaction(tx, w.PrivateKey)
+	tx.ID = tx.Hash()
+	return tx
+}
 
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&transaction)
-	HandleError(err)
-	return transaction
+// NewMultisigTransaction spends from the multisig address ms, signing with
+// the keys of signers.
+func NewMultisigTransaction(ms *wallet.Multisig, signers []*wallet.Wallet, to string, amount, fee int, lockTime uint32, UTXO *UTXOSet) *Transaction {
+	scriptHash := wallet.PublicKeyHash(ms.RedeemScript)
+	tx := newSpend(scriptHash, string(ms.Address()), to, amount, fee, lockTime, UTXO)
+
+	var privKeys []ecdsa.PrivateKey
+	for _, w := range signers {
+		privKeys = append(privKeys, w.PrivateKey)
+	}
+	UTXO.Blockchain.SignMultisigTransaction(tx, privKeys, ms.RedeemScript)
+	tx.ID = tx.Hash()
+	return tx
 }
 
-func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Transaction {
+// newSpend builds an unsigned transaction paying amount to to from the
+// outputs locked to pubKeyHash. Whatever is left after fee goes back to from.
+func newSpend(pubKeyHash []byte, from, to string, amount, fee int, lockTime uint32, UTXO *UTXOSet) *Transaction {
+	// Inputs must not all be final for the lock time to take effect.
+	var sequence uint32 = SequenceFinal
+	if lockTime > 0 {
+		sequence = SequenceFinal - 1
+	}
 	var inputs []TxInput
 	var outputs []TxOutput
 
-	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
-
-	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount+fee)
 
-	if acc < amount {
-		log.Panicf("Not enough funds: %d < %d", acc, amount)
+	if acc < amount+fee {
+		log.Panicf("Not enough funds: %d < %d", acc, amount+fee)
 	}
 
 	for txid, outs := range validOutputs {
 		txID, err := hex.DecodeString(txid)
 		HandleError(err)
 		for _, out := range outs {
-			input := TxInput{txID, out, nil, w.PublicKey}
+			input := TxInput{txID, out, nil, sequence}
 			inputs = append(inputs, input)
 		}
 	}
-	from := string(w.Address())
 	outputs = append(outputs, *NewTXOutput(amount, to))
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc - amount, from))
+	if acc > amount+fee {
+		outputs = append(outputs, *NewTXOutput(acc - amount - fee, from))
 	}
-	tx := Transaction{nil, inputs, outputs}
-	tx.ID = tx.Hash()
-	UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey)
-	return &tx
+	return &Transaction{nil, inputs, outputs, lockTime}
 }
 
-func CoinbaseTx(to, data string) *Transaction {
+// CoinbaseTx pays reward, the subsidy plus the fees of the block it goes
+// into, to to.
+func CoinbaseTx(to, data string, reward int) *Transaction {
 	if data == "" {
 		randData := make([]byte, 24)
 		_, err := rand.Read(randData)
@@ -167,10 +318,10 @@ func CoinbaseTx(to, data string) *Transaction {
 		data = fmt.Sprintf("%x", randData)
 	}
 
-	txin := TxInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTXOutput(20, to)
+	txin := TxInput{[]byte{}, -1, pushData(nil, []byte(data)), SequenceFinal}
+	txout := NewTXOutput(reward, to)
 
-	tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}}
+	tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}, 0}
 	tx.ID = tx.Hash()
 
 	return &tx
@@ -180,18 +331,23 @@ func (tx Transaction) String() string {
 	var lines []string
 
 	lines = append(lines, fmt.Sprintf("--- Transaction %x:", tx.ID))
+	if tx.LockTime != 0 {
+		lines = append(lines, fmt.Sprintf("     LockTime: %d", tx.LockTime))
+	}
 	for i, input := range tx.Inputs {
 		lines = append(lines, fmt.Sprintf("     Input %d:", i))
 		lines = append(lines, fmt.Sprintf("       TXID:     %x", input.ID))
 		lines = append(lines, fmt.Sprintf("       Out:       %d", input.OutIndex))
-		lines = append(lines, fmt.Sprintf("       Signature: %x", input.Sig))
-		lines = append(lines, fmt.Sprintf("       PubKey:    %x", input.PubKey))
+		if input.Sequence != SequenceFinal {
+			lines = append(lines, fmt.Sprintf("       Sequence:  %d", input.Sequence))
+		}
+		lines = append(lines, fmt.Sprintf("       Script:    %s", DisassembleScript(input.ScriptSig)))
 	}
 
 	for i, output := range tx.Outputs {
 		lines = append(lines, fmt.Sprintf("     Output %d:", i))
 		lines = append(lines, fmt.Sprintf("       Value:  %d", output.Value))
-		lines = append(lines, fmt.Sprintf("       Script: %x", output.ScriptPubKey))
+		lines = append(lines, fmt.Sprintf("       Script: %s", DisassembleScript(output.ScriptPubKey)))
 	}
 
 	return strings.Join(lines, "\n")
@@ -2,42 +2,98 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/gob"
 
 	"github.com/nthskyradiated/go-bc/wallet"
 )
 
+// TxInput spends an earlier output. ScriptSig is the unlocking script run
+// against the output's ScriptPubKey; for a coinbase it carries arbitrary data.
+// The transaction's lock time only applies if an input has a Sequence below
+// SequenceFinal.
 type TxInput struct {
-	ID       []byte
-	OutIndex int
-	Sig      []byte
-	PubKey   []byte
+	ID        []byte
+	OutIndex  int
+	ScriptSig []byte
+	Sequence  uint32
 }
 
-// * TODO: implement the script
+// TxOutput locks Value with the script ScriptPubKey.
 type TxOutput struct {
 	Value        int
 	ScriptPubKey []byte
 }
 
+// TxOutputs holds the unspent outputs of a single transaction. Indexes
+// records the position of each entry in the transaction's output list, so
+// that spending one output does not shift the index of the others. Height is
+// the height of the block holding the transaction.
 type TxOutputs struct{
-	Outputs []TxOutput
+	Outputs  []TxOutput
+	Indexes  []int
+	Height   int
+	Coinbase bool
 }
 
+// UsesKey reports whether the input's unlocking script ends with a public
+// key hashing to pubKeyHash.
 func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
-	lockingHash := wallet.PublicKeyHash(in.PubKey)
+	data := pushedData(in.ScriptSig)
+	if len(data) == 0 {
+		return false
+	}
+	lockingHash := wallet.PublicKeyHash(data[len(data)-1])
 	return bytes.Equal(lockingHash, pubKeyHash)
 }
 
+// Lock locks the output to address with a P2PKH script, or a P2SH script
+// for a script address.
 func (out *TxOutput) Lock(address []byte) {
 	pubKeyHash := wallet.Base58Decode([]byte(address))
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	out.ScriptPubKey = pubKeyHash
+	if wallet.IsScriptAddress(address) {
+		out.ScriptPubKey = P2SHScript(pubKeyHash)
+		return
+	}
+	out.ScriptPubKey = P2PKHScript(pubKeyHash)
 }
 
 func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	// lockingHash := wallet.PublicKeyHash(out.ScriptPubKey)
-	return bytes.Equal(out.ScriptPubKey, pubKeyHash)
+	return bytes.Equal(out.PubKeyHash(), pubKeyHash)
+}
+
+// PubKeyHash returns the hash encoded in the address of a standard output:
+// the public key hash of a P2PKH output or the script hash of a P2SH one.
+// It is nil if the script is not a standard one.
+func (out *TxOutput) PubKeyHash() []byte {
+	if hash := ExtractPubKeyHash(out.ScriptPubKey); hash != nil {
+		return hash
+	}
+	return ExtractScriptHash(out.ScriptPubKey)
+}
+
+// Serialize encodes the output as its value, an int64, followed by its
+// length-prefixed locking script.
+func (out TxOutput) Serialize() []byte {
+	return out.appendTo(nil)
+}
+
+func (out TxOutput) appendTo(b []byte) []byte {
+	b = appendUint64(b, uint64(int64(out.Value)))
+	return appendBytes(b, out.ScriptPubKey)
+}
+
+func DeserializeOutput(data []byte) TxOutput {
+	r := &reader{data: data}
+	out := readOutput(r)
+	HandleError(r.finish())
+	return out
+}
+
+func readOutput(r *reader) TxOutput {
+	var out TxOutput
+	out.Value = int(int64(r.uint64()))
+	out.ScriptPubKey = r.bytes()
+	return out
 }
 
 func NewTXOutput(value int, address string) *TxOutput {
@@ -46,18 +102,103 @@ func NewTXOutput(value int, address string) *TxOutput {
 	return out
 }
 
+// IsMature reports whether the outputs may be spent by a block at height.
+// Coinbase outputs must wait Params.CoinbaseMaturity blocks, except those of
+// the genesis block, which fund the first transactions of a new chain.
+func (outs TxOutputs) IsMature(height int) bool {
+	return !outs.Coinbase || outs.Height == 0 || height-outs.Height >= Params.CoinbaseMaturity
+}
+
+// Index returns the original output index of the i-th unspent output.
+func (outs TxOutputs) Index(i int) int {
+	if outs.Indexes == nil {
+		return i
+	}
+	return outs.Indexes[i]
+}
+
+// Get returns the unspent output at output index idx.
+func (outs TxOutputs) Get(idx int) (TxOutput, bool) {
+	for i, out := range outs.Outputs {
+		if outs.Index(i) == idx {
+			return out, true
+		}
+	}
+	return TxOutput{}, false
+}
+
+// Add inserts out at output index idx, keeping the entries ordered.
+func (outs *TxOutputs) Add(idx int, out TxOutput) {
+	if outs.Indexes == nil {
+		for i := range outs.Outputs {
+			outs.Indexes = append(outs.Indexes, i)
+		}
+	}
+	pos := 0
+	for pos < len(outs.Indexes) && outs.Indexes[pos] < idx {
+		pos++
+	}
+	if pos < len(outs.Indexes) && outs.Indexes[pos] == idx {
+		outs.Outputs[pos] = out
+		return
+	}
+	outs.Outputs = append(outs.Outputs[:pos], append([]TxOutput{out}, outs.Outputs[pos:]...)...)
+	outs.Indexes = append(outs.Indexes[:pos], append([]int{idx}, outs.Indexes[pos:]...)...)
+}
+
+// Remove drops the output at output index idx and reports whether it was present.
+func (outs *TxOutputs) Remove(idx int) bool {
+	for i := range outs.Outputs {
+		if outs.Index(i) != idx {
+			continue
+		}
+		if outs.Indexes == nil {
+			for j := range outs.Outputs {
+				outs.Indexes = append(outs.Indexes, j)
+			}
+		}
+		outs.Outputs = append(outs.Outputs[:i], outs.Outputs[i+1:]...)
+		outs.Indexes = append(outs.Indexes[:i], outs.Indexes[i+1:]...)
+		return true
+	}
+	return false
+}
+
+// Serialize encodes the entry as the block height, an int64, a coinbase flag
+// byte and the list of outputs, each preceded by its uint32 output index.
 func (outs TxOutputs) Serialize() []byte {
-	var encoded bytes.Buffer
-	encode := gob.NewEncoder(&encoded)
-	err := encode.Encode(outs)
-	HandleError(err)
-	return encoded.Bytes()
+	b := appendUint64(nil, uint64(int64(outs.Height)))
+	if outs.Coinbase {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = appendUint32(b, uint32(len(outs.Outputs)))
+	for i, out := range outs.Outputs {
+		b = appendUint32(b, uint32(outs.Index(i)))
+		b = out.appendTo(b)
+	}
+	return b
 }
 
 func DeserializeOutputs(data []byte) TxOutputs {
-	var outs TxOutputs
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&outs)
+	outs, err := DecodeOutputs(data)
 	HandleError(err)
 	return outs
-}
\ No newline at end of file
+}
+
+// DecodeOutputs is DeserializeOutputs for data that may be malformed.
+func DecodeOutputs(data []byte) (TxOutputs, error) {
+	r := &reader{data: data}
+	var outs TxOutputs
+	outs.Height = int(int64(r.uint64()))
+	if flag := r.next(1); flag != nil {
+		outs.Coinbase = flag[0] == 1
+	}
+	count := r.count(16)
+	for i := 0; i < count; i++ {
+		outs.Indexes = append(outs.Indexes, int(r.uint32()))
+		outs.Outputs = append(outs.Outputs, readOutput(r))
+	}
+	return outs, r.finish()
+}
@@ -0,0 +1,114 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
+
+var (
+	txIndexPrefix = []byte("tx-")
+	txIndexKey    = []byte("txindex")
+)
+
+var ErrTxIndexDisabled = errors.New("transaction index is disabled, run reindextx to build it")
+
+// TxLocation is the position of a transaction on the main chain.
+type TxLocation struct {
+	BlockHash []byte
+	Index     int
+}
+
+func (loc TxLocation) Serialize() []byte {
+	var encoded bytes.Buffer
+	encoder := gob.NewEncoder(&encoded)
+	err := encoder.Encode(loc)
+	HandleError(err)
+	return encoded.Bytes()
+}
+
+func DeserializeTxLocation(data []byte) TxLocation {
+	var loc TxLocation
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&loc)
+	HandleError(err)
+	return loc
+}
+
+// indexBlock records the location of every transaction in block.
+func indexBlock(txn Txn, block *Block) error {
+	for i, tx := range block.Transactions {
+		loc := TxLocation{block.Hash, i}
+		if err := txn.Set(prefixedKey(txIndexPrefix, tx.ID), loc.Serialize()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexBlock removes the transactions of a disconnected block.
+func unindexBlock(txn Txn, block *Block) error {
+	for _, tx := range block.Transactions {
+		if err := txn.Delete(prefixedKey(txIndexPrefix, tx.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetTransaction looks the transaction up in the index and returns it
+// together with the block that contains it.
+func (chain *BlockChain) GetTransaction(ID []byte) (*Transaction, *Block, error) {
+	if !chain.TxIndex {
+		return nil, nil, ErrTxIndexDisabled
+	}
+	var tx *Transaction
+	var block *Block
+	err := chain.Database.View(func(txn Txn) error {
+		v, err := txn.Get(prefixedKey(txIndexPrefix, ID))
+		if err == ErrKeyNotFound {
+			return errors.New("transaction not found")
+		}
+		if err != nil {
+			return err
+		}
+		loc := DeserializeTxLocation(v)
+		if block, err = getBlock(txn, loc.BlockHash); err != nil {
+			return err
+		}
+		tx = block.Transactions[loc.Index]
+		return nil
+	})
+	return tx, block, err
+}
+
+// ReindexTransactions rebuilds the transaction index from the main chain and
+// enables it. It returns the number of indexed transactions.
+func (chain *BlockChain) ReindexTransactions() int {
+	if chain.PrunedHeight() >= 0 {
+		HandleError(fmt.Errorf("cannot reindex a pruned chain: %w", ErrPruned))
+	}
+	chain.DeleteByPrefix(txIndexPrefix)
+
+	count := 0
+	iter := chain.Iterator()
+	for {
+		block := iter.Next()
+		err := chain.Database.Update(func(txn Txn) error {
+			return indexBlock(txn, block)
+		})
+		HandleError(err)
+		count += len(block.Transactions)
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	err := chain.Database.Update(func(txn Txn) error {
+		return txn.Set(txIndexKey, []byte{1})
+	})
+	HandleError(err)
+	chain.TxIndex = true
+	return count
+}
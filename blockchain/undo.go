@@ -0,0 +1,46 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+var undoPrefix = []byte("undo-")
+
+// SpentOutput is an output consumed by a block, kept so the block can be
+// disconnected without searching the chain for it.
+type SpentOutput struct {
+	Output   TxOutput
+	Height   int
+	Coinbase bool
+}
+
+// BlockUndo lists the outputs a block spent, in the order of its inputs.
+type BlockUndo struct {
+	Spent []SpentOutput
+}
+
+func (undo BlockUndo) Serialize() []byte {
+	var encoded bytes.Buffer
+	encoder := gob.NewEncoder(&encoded)
+	err := encoder.Encode(undo)
+	HandleError(err)
+	return encoded.Bytes()
+}
+
+func DeserializeUndo(data []byte) BlockUndo {
+	var undo BlockUndo
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&undo)
+	HandleError(err)
+	return undo
+}
+
+// getUndo loads the undo record of block, which every connected block has.
+func getUndo(txn Txn, block *Block) (BlockUndo, error) {
+	v, err := txn.Get(prefixedKey(undoPrefix, block.Hash))
+	if err != nil {
+		return BlockUndo{}, err
+	}
+	return DeserializeUndo(v), nil
+}
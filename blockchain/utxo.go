@@ -1,11 +1,8 @@
 package blockchain
 
 import (
-	"bytes"
 	"encoding/hex"
-	"log"
-
-	"github.com/dgraph-io/badger"
+	"fmt"
 )
 
 var (
@@ -17,189 +14,334 @@ type UTXOSet struct {
 	Blockchain *BlockChain
 }
 
+// Reindex rebuilds the UTXO set, the address index and the undo records by
+// replaying every block of the main chain from the genesis block.
 func (u UTXOSet) Reindex() {
 	db := u.Blockchain.Database
+	if u.Blockchain.PrunedHeight() >= 0 {
+		HandleError(fmt.Errorf("cannot reindex a pruned chain: %w", ErrPruned))
+	}
 	u.DeleteByPrefix(utxoPrefix)
-	UTXO := u.Blockchain.FindUTXO()
+	u.DeleteByPrefix(addrUTXOPrefix)
+	u.DeleteByPrefix(addrHistoryPrefix)
+	u.DeleteByPrefix(undoPrefix)
 
-	err := db.Update(func(txn *badger.Txn) error {
-		for txID, outputs := range UTXO {
-			key, err := hex.DecodeString(txID)
-			if err != nil {
-				return err
-			}
-			key = append(utxoPrefix, key...)
-			err = txn.Set(key, outputs.Serialize())
-			HandleError(err)
-		}
-		return nil
-	})
-	HandleError(err)
+	hashes := u.Blockchain.GetBlockHashes()
+	for i := len(hashes) - 1; i >= 0; i-- {
+		block, err := u.Blockchain.GetBlock(hashes[i])
+		HandleError(err)
+		err = db.Update(func(txn Txn) error {
+			return u.connect(txn, &block)
+		})
+		HandleError(err)
+	}
 }
 
 func (u *UTXOSet) Update(block *Block) {
 	db := u.Blockchain.Database
-	err := db.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if !tx.IsCoinbase() {
-				for _, input := range tx.Inputs {
-				updatedOuts := TxOutputs{}
-				inID := append(utxoPrefix, input.ID...)
-					item, err := txn.Get(inID)
-				HandleError(err)
-				v, err := item.ValueCopy(nil)
-				HandleError(err)
-
-				outs := DeserializeOutputs(v)
-				for outIdx, out := range outs.Outputs {
-					if outIdx != input.OutIndex {
-						updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-					}
+	err := db.Update(func(txn Txn) error {
+		return u.connect(txn, block)
+	})
+	HandleError(err)
+}
+
+// connect validates the transactions of block against the UTXO set and
+// applies them: the outputs they spend are removed, and saved in the block's
+// undo record, and the outputs they create are added. Every input must spend an existing unspent output with a
+// valid signature, no transaction may create more value than it spends, and
+// none may reuse the ID of a transaction with unspent outputs.
+// Signatures are not checked in ancestors of the assume-valid block.
+func (u *UTXOSet) connect(txn Txn, block *Block) error {
+	var undo BlockUndo
+	fees := 0
+	assumedValid, err := u.Blockchain.assumedValid(txn, block)
+	if err != nil {
+		return err
+	}
+	checkSigs := !assumedValid
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			// Verify only reads the spent output of each input, so the
+			// previous transactions are rebuilt from the UTXO set.
+			prevTXs := make(map[string]Transaction)
+			var spent []TxOutput
+			inputValue := 0
+			for _, input := range tx.Inputs {
+				inID := prefixedKey(utxoPrefix, input.ID)
+				outs, err := getOutputs(txn, inID)
+				if err == ErrKeyNotFound {
+					return txError(block, tx, ErrMissingInput)
 				}
-				if len(updatedOuts.Outputs) == 0 {
-					if err := txn.Delete(inID); err != nil {
-						log.Panic(err)
-					}
+				if err != nil {
+					return err
+				}
+				out, ok := outs.Get(input.OutIndex)
+				if !ok {
+					return txError(block, tx, ErrMissingInput)
+				}
+				if !outs.IsMature(block.Height) {
+					return txError(block, tx, ErrImmatureSpend)
+				}
+				if inputValue, ok = addValue(inputValue, out.Value); !ok {
+					return txError(block, tx, ErrValueOutOfRange)
+				}
+				spent = append(spent, out)
+				undo.Spent = append(undo.Spent, SpentOutput{out, outs.Height, outs.Coinbase})
+
+				prevTX := prevTXs[hex.EncodeToString(input.ID)]
+				prevTX.ID = input.ID
+				for len(prevTX.Outputs) <= input.OutIndex {
+					prevTX.Outputs = append(prevTX.Outputs, TxOutput{})
+				}
+				prevTX.Outputs[input.OutIndex] = out
+				prevTXs[hex.EncodeToString(input.ID)] = prevTX
+
+				outs.Remove(input.OutIndex)
+				if len(outs.Outputs) == 0 {
+					err = txn.Delete(inID)
 				} else {
-					if err := txn.Set(inID, updatedOuts.Serialize()); err != nil {
-						log.Panic(err)
-					}
+					err = txn.Set(inID, outs.Serialize())
 				}
+				if err != nil {
+					return err
+				}
+			}
+			outValue, ok := outputValue(tx)
+			if !ok {
+				return txError(block, tx, ErrValueOutOfRange)
+			}
+			if outValue > inputValue {
+				return txError(block, tx, ErrInsufficientFunds)
+			}
+			if fees, ok = addValue(fees, inputValue-outValue); !ok {
+				return txError(block, tx, ErrValueOutOfRange)
+			}
+			if checkSigs && !tx.Verify(prevTXs) {
+				return txError(block, tx, ErrBadSignature)
+			}
+			if err := indexTransaction(txn, block.Height, tx, spent); err != nil {
+				return err
 			}
+		} else if err := indexTransaction(txn, block.Height, tx, nil); err != nil {
+			return err
+		}
+		// A copy of an earlier transaction, such as a coinbase paying the
+		// same address with the same data, has its ID. Its outputs would
+		// replace the unspent ones of the original, and disconnecting it
+		// would delete them.
+		key := prefixedKey(utxoPrefix, tx.ID)
+		if _, err := txn.Get(key); err == nil {
+			return txError(block, tx, ErrOverwriteTx)
+		} else if err != ErrKeyNotFound {
+			return err
+		}
+		newOutputs := TxOutputs{Height: block.Height, Coinbase: tx.IsCoinbase()}
+		for outIdx, out := range tx.Outputs {
+			newOutputs.Add(outIdx, out)
 		}
-		newOutputs := TxOutputs{}
-			newOutputs.Outputs = append(newOutputs.Outputs, tx.Outputs...)
-			txID := append(utxoPrefix, tx.ID...)
-			if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
-				log.Panic(err)
+		if err := txn.Set(key, newOutputs.Serialize()); err != nil {
+			return err
+		}
+	}
+	reward, ok := outputValue(block.Transactions[0])
+	if !ok {
+		return txError(block, block.Transactions[0], ErrValueOutOfRange)
+	}
+	if reward > Params.Subsidy(block.Height)+fees {
+		return blockError(block, ErrBadReward)
+	}
+	return txn.Set(prefixedKey(undoPrefix, block.Hash), undo.Serialize())
+}
+
+// spendsImmatureCoinbase reports whether tx spends a coinbase output that a
+// block at height may not spend yet.
+func (u UTXOSet) spendsImmatureCoinbase(tx *Transaction, height int) bool {
+	immature := false
+	err := u.Blockchain.Database.View(func(txn Txn) error {
+		for _, input := range tx.Inputs {
+			outs, err := getOutputs(txn, prefixedKey(utxoPrefix, input.ID))
+			if err == ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !outs.IsMature(height) {
+				immature = true
 			}
 		}
 		return nil
 	})
 	HandleError(err)
+	return immature
 }
 
-func (u *UTXOSet) CountTransactions() int {
-	db := u.Blockchain.Database
-	count := 0
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			count++
-		}
-		return nil
+// TotalValue returns the value of every unspent output.
+func (u UTXOSet) TotalValue() int {
+	total := 0
+	err := u.Blockchain.Database.View(func(txn Txn) error {
+		return txn.Scan(utxoPrefix, func(_, v []byte) error {
+			for _, out := range DeserializeOutputs(v).Outputs {
+				total += out.Value
+			}
+			return nil
+		})
 	})
 	HandleError(err)
-	return count
+	return total
 }
 
-func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
-	deleteKeys := func(keysForDelete [][]byte) error {
-		if err := u.Blockchain.Database.Update(func(txn *badger.Txn) error {
-			for _, key := range keysForDelete {
-				if err := txn.Delete(key); err != nil {
-					return err
-				}
+// Fee returns the value tx leaves unclaimed for the miner: its inputs, taken
+// from the UTXO set, minus its outputs.
+func (u UTXOSet) Fee(tx *Transaction) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+	inputValue := 0
+	err := u.Blockchain.Database.View(func(txn Txn) error {
+		for _, input := range tx.Inputs {
+			outs, err := getOutputs(txn, prefixedKey(utxoPrefix, input.ID))
+			if err == ErrKeyNotFound {
+				return ErrMissingInput
+			}
+			if err != nil {
+				return err
+			}
+			out, ok := outs.Get(input.OutIndex)
+			if !ok {
+				return ErrMissingInput
+			}
+			if inputValue, ok = addValue(inputValue, out.Value); !ok {
+				return ErrValueOutOfRange
 			}
-			return nil
-		}); err != nil {
-			return err
 		}
 		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
+	outValue, ok := outputValue(tx)
+	if !ok {
+		return 0, ErrValueOutOfRange
+	}
+	return inputValue - outValue, nil
+}
 
-	collectSize := 100000
-	u.Blockchain.Database.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		keysForDelete := make([][]byte, 0, collectSize)
-		keysCollected := 0
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			key := it.Item().KeyCopy(nil)
-			keysForDelete = append(keysForDelete, key)
-			keysCollected++
-			if keysCollected == collectSize {
-				if err := deleteKeys(keysForDelete); err != nil {
-					log.Panic(err)
-				}
-				keysForDelete = make([][]byte, 0, collectSize)
-				keysCollected = 0
+// Disconnect reverts Update for block using its undo record.
+func (u *UTXOSet) Disconnect(block *Block) {
+	db := u.Blockchain.Database
+	err := db.Update(func(txn Txn) error {
+		return u.disconnect(txn, block)
+	})
+	HandleError(err)
+}
+
+// disconnect reverts connect for block, which must be the block at the tip
+// of the chain the UTXO set currently reflects. The outputs it spent are
+// restored from its undo record.
+func (u *UTXOSet) disconnect(txn Txn, block *Block) error {
+	undo, err := getUndo(txn, block)
+	if err != nil {
+		return err
+	}
+
+	next := len(undo.Spent)
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+		if err := txn.Delete(prefixedKey(utxoPrefix, tx.ID)); err != nil {
+			return err
+		}
+		if tx.IsCoinbase() {
+			if err := unindexTransaction(txn, block.Height, tx, nil); err != nil {
+				return err
 			}
+			continue
 		}
-		if keysCollected > 0 {
-			if err := deleteKeys(keysForDelete); err != nil {
-				log.Panic(err)
+
+		next -= len(tx.Inputs)
+		var spent []TxOutput
+		for j, input := range tx.Inputs {
+			restored := undo.Spent[next+j]
+			spent = append(spent, restored.Output)
+			inID := prefixedKey(utxoPrefix, input.ID)
+			outs, err := getOutputs(txn, inID)
+			if err == ErrKeyNotFound {
+				outs, err = TxOutputs{Height: restored.Height, Coinbase: restored.Coinbase}, nil
+			}
+			if err != nil {
+				return err
+			}
+			outs.Add(input.OutIndex, restored.Output)
+			if err := txn.Set(inID, outs.Serialize()); err != nil {
+				return err
 			}
 		}
-		return nil
+		if err := unindexTransaction(txn, block.Height, tx, spent); err != nil {
+			return err
+		}
+	}
+	return txn.Delete(prefixedKey(undoPrefix, block.Hash))
+}
 
+func getOutputs(txn Txn, key []byte) (TxOutputs, error) {
+	v, err := txn.Get(key)
+	if err != nil {
+		return TxOutputs{}, err
+	}
+	return DeserializeOutputs(v), nil
+}
+
+func (u *UTXOSet) CountTransactions() int {
+	db := u.Blockchain.Database
+	count := 0
+	err := db.View(func(txn Txn) error {
+		return txn.Scan(utxoPrefix, func(_, _ []byte) error {
+			count++
+			return nil
+		})
 	})
+	HandleError(err)
+	return count
+}
 
+func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
+	u.Blockchain.DeleteByPrefix(prefix)
 }
 
 func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
 	var unspentTxs []TxOutput
-
-	db := u.Blockchain.Database
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			v, err := item.ValueCopy(nil)
-			HandleError(err)
-			outs := DeserializeOutputs(v)
-			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
-					unspentTxs = append(unspentTxs, out)
-				}
-			}
-		}
-		return nil
+	u.forEachAddressUTXO(pubKeyHash, func(txID string, outIdx int, out TxOutput, mature bool) bool {
+		unspentTxs = append(unspentTxs, out)
+		return true
 	})
-	HandleError(err)	
 	return unspentTxs
 }
 
-
-
+// Balance returns the value locked to pubKeyHash that the next block may
+// spend, and the value held in coinbase outputs that have not matured.
+func (u UTXOSet) Balance(pubKeyHash []byte) (int, int) {
+	spendable, immature := 0, 0
+	u.forEachAddressUTXO(pubKeyHash, func(txID string, outIdx int, out TxOutput, mature bool) bool {
+		if mature {
+			spendable += out.Value
+		} else {
+			immature += out.Value
+		}
+		return true
+	})
+	return spendable, immature
+}
 
 func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
 	unspentOuts := make(map[string][]int)
 	accumulated := 0
-	db := u.Blockchain.Database
-
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			k := item.Key()
-			var v []byte
-			v, err := item.ValueCopy(nil)
-			HandleError(err)
-			k = bytes.TrimPrefix(k, utxoPrefix)
-			txID := hex.EncodeToString(k)
-			outs := DeserializeOutputs(v)
-
-			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOuts[txID] = append(unspentOuts[txID], outIdx)
-				}
-			}
+	u.forEachAddressUTXO(pubKeyHash, func(txID string, outIdx int, out TxOutput, mature bool) bool {
+		if !mature {
+			return true
 		}
-		return nil
+		accumulated += out.Value
+		unspentOuts[txID] = append(unspentOuts[txID], outIdx)
+		return accumulated < amount
 	})
-	HandleError(err)
 	return accumulated, unspentOuts
-}
\ No newline at end of file
+}
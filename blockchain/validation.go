@@ -0,0 +1,334 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+var invalidPrefix = []byte("bad-")
+
+var (
+	ErrBadVersion        = errors.New("block version is not supported")
+	ErrBadBlockHash      = errors.New("block hash does not match its header")
+	ErrBadMerkleRoot     = errors.New("merkle root does not match the block transactions")
+	ErrBadDifficulty     = errors.New("block difficulty does not match the retarget schedule")
+	ErrProofOfWork       = errors.New("block hash does not meet the proof-of-work target")
+	ErrBadSeal           = errors.New("block is not signed by the authority in turn")
+	ErrOrphanBlock       = errors.New("parent block is unknown")
+	ErrInvalidParent     = errors.New("block builds on an invalid block")
+	ErrBadHeight         = errors.New("block height does not follow its parent")
+	ErrCheckpoint        = errors.New("block hash does not match the checkpoint at its height")
+	ErrCheckpointFork    = errors.New("block branches off the chain below a checkpoint")
+	ErrPrunedFork        = errors.New("block branches off the chain below its pruned blocks")
+	ErrTimeTooOld        = errors.New("block timestamp is not after the median time past")
+	ErrTimeTooNew        = errors.New("block timestamp is too far in the future")
+	ErrNoTransactions    = errors.New("block has no transactions")
+	ErrBlockTooLarge     = errors.New("block exceeds the size limit")
+	ErrTooManyTxs        = errors.New("block exceeds the transaction count limit")
+	ErrBadCoinbase       = errors.New("block must have exactly one coinbase, in first position")
+	ErrBadReward         = errors.New("coinbase pays more than the subsidy plus the block's fees")
+	ErrBadTxID           = errors.New("transaction ID does not match its contents")
+	ErrDuplicateTx       = errors.New("transaction appears twice in the block")
+	ErrOverwriteTx       = errors.New("transaction ID matches a transaction with unspent outputs")
+	ErrNegativeValue     = errors.New("transaction output has a negative value")
+	ErrDoubleSpend       = errors.New("output is spent twice in the block")
+	ErrMissingInput      = errors.New("input spends a missing or already spent output")
+	ErrInsufficientFunds = errors.New("transaction outputs exceed its inputs")
+	ErrValueOutOfRange   = errors.New("transaction value exceeds the money supply")
+	ErrBadSignature      = errors.New("transaction signature is invalid")
+	ErrNonFinalTx        = errors.New("transaction lock time has not passed")
+	ErrImmatureSpend     = errors.New("input spends a coinbase output that has not matured")
+)
+
+// BlockError reports why the block with the given hash was rejected. Err is
+// one of the Err* values above, possibly wrapped with more detail.
+type BlockError struct {
+	Hash []byte
+	Err  error
+}
+
+func (e *BlockError) Error() string {
+	if len(e.Hash) == 0 {
+		return fmt.Sprintf("invalid block: %v", e.Err)
+	}
+	return fmt.Sprintf("invalid block %x: %v", e.Hash, e.Err)
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+func blockError(block *Block, err error) error {
+	return &BlockError{block.Hash, err}
+}
+
+// TxError reports why the transaction with the given ID made its block
+// invalid. It is wrapped in a *BlockError.
+type TxError struct {
+	ID  []byte
+	Err error
+}
+
+func (e *TxError) Error() string {
+	return fmt.Sprintf("transaction %x: %v", e.ID, e.Err)
+}
+
+func (e *TxError) Unwrap() error {
+	return e.Err
+}
+
+func txError(block *Block, tx *Transaction, err error) error {
+	return &BlockError{block.Hash, &TxError{tx.ID, err}}
+}
+
+// CheckBlock runs the checks that need nothing but the block itself and the
+// consensus engine: the header hash and seal, then the transaction list.
+func CheckBlock(engine Engine, block *Block) error {
+	if err := checkHeaderFields(block); err != nil {
+		return err
+	}
+	if !bytes.Equal(block.BlockHeader.Hash(), block.Hash) {
+		return blockError(block, ErrBadBlockHash)
+	}
+	if err := engine.VerifySeal(block); err != nil {
+		return blockError(block, err)
+	}
+	if err := checkBlockBody(block); err != nil {
+		return err
+	}
+	if !bytes.Equal(block.HashTransactions(), block.MerkleRoot) {
+		return blockError(block, ErrBadMerkleRoot)
+	}
+	return nil
+}
+
+// checkHeaderFields checks that the header fields the engines rely on are in
+// range, which must be done before a seal is verified.
+func checkHeaderFields(block *Block) error {
+	if block.Version < 1 || block.Version > BlockVersion {
+		return blockError(block, ErrBadVersion)
+	}
+	if block.Difficulty < MinDifficulty || block.Difficulty > MaxDifficulty {
+		return blockError(block, ErrBadDifficulty)
+	}
+	if block.Height < 0 {
+		return blockError(block, ErrBadHeight)
+	}
+	if block.Height > 0 && len(block.PrevHash) == 0 {
+		return blockError(block, ErrOrphanBlock)
+	}
+	return nil
+}
+
+func checkBlockBody(block *Block) error {
+	if len(block.Transactions) == 0 {
+		return blockError(block, ErrNoTransactions)
+	}
+	if len(block.Transactions) > Params.MaxBlockTransactions {
+		return blockError(block, ErrTooManyTxs)
+	}
+	if len(block.Serialize()) > Params.MaxBlockSize {
+		return blockError(block, ErrBlockTooLarge)
+	}
+
+	txIDs := make(map[string]bool)
+	spent := make(map[string]bool)
+	for i, tx := range block.Transactions {
+		if tx.IsCoinbase() != (i == 0) {
+			return blockError(block, ErrBadCoinbase)
+		}
+		if !bytes.Equal(tx.ID, tx.Hash()) {
+			return txError(block, tx, ErrBadTxID)
+		}
+		if txIDs[hex.EncodeToString(tx.ID)] {
+			return txError(block, tx, ErrDuplicateTx)
+		}
+		txIDs[hex.EncodeToString(tx.ID)] = true
+
+		for _, out := range tx.Outputs {
+			if out.Value < 0 {
+				return txError(block, tx, ErrNegativeValue)
+			}
+		}
+		if _, ok := outputValue(tx); !ok {
+			return txError(block, tx, ErrValueOutOfRange)
+		}
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			outpoint := fmt.Sprintf("%x:%d", in.ID, in.OutIndex)
+			if spent[outpoint] {
+				return txError(block, tx, ErrDoubleSpend)
+			}
+			spent[outpoint] = true
+		}
+	}
+	return nil
+}
+
+// addValue adds value to total, a sum of coin amounts. It fails if value is
+// negative or the sum would pass MaxSupply, which no amount of coins can
+// exceed, so sums of amounts from untrusted blocks never overflow.
+func addValue(total, value int) (int, bool) {
+	if value < 0 || value > Params.MaxSupply-total {
+		return 0, false
+	}
+	return total + value, true
+}
+
+// outputValue is OutputValue for transactions that have not been validated.
+// It fails like addValue.
+func outputValue(tx *Transaction) (int, bool) {
+	total := 0
+	for _, out := range tx.Outputs {
+		var ok bool
+		if total, ok = addValue(total, out.Value); !ok {
+			return 0, false
+		}
+	}
+	return total, true
+}
+
+// checkBlockContext checks block against its parent, which must be stored
+// and not known to be invalid, the checkpoints and the difficulty schedule.
+func checkBlockContext(txn Txn, block *Block) error {
+	// Only the genesis block has no parent, and it is never added.
+	if len(block.PrevHash) == 0 {
+		return blockError(block, ErrOrphanBlock)
+	}
+	if _, err := txn.Get(prefixedKey(invalidPrefix, block.PrevHash)); err == nil {
+		return blockError(block, ErrInvalidParent)
+	}
+	parent, err := getBlock(txn, block.PrevHash)
+	if err == ErrKeyNotFound {
+		return blockError(block, ErrOrphanBlock)
+	}
+	if err != nil {
+		return err
+	}
+	if block.Height != parent.Height+1 {
+		return blockError(block, ErrBadHeight)
+	}
+	if err := checkCheckpoints(txn, block); err != nil {
+		return err
+	}
+	mtp, err := medianTimePast(txn, parent)
+	if err != nil {
+		return err
+	}
+	if block.Timestamp <= mtp {
+		return blockError(block, ErrTimeTooOld)
+	}
+	difficulty, err := nextDifficulty(txn, parent)
+	if err != nil {
+		return err
+	}
+	if block.Difficulty != difficulty {
+		return blockError(block, ErrBadDifficulty)
+	}
+	// Lock times are compared with the median time past rather than the
+	// block timestamp, which the miner chooses.
+	for _, tx := range block.Transactions {
+		if !tx.IsFinal(block.Height, mtp) {
+			return txError(block, tx, ErrNonFinalTx)
+		}
+	}
+	return nil
+}
+
+// checkCheckpoints rejects a block that conflicts with a checkpoint, or that
+// would start a branch at or below the last checkpoint the chain has passed
+// or at or below its pruned blocks.
+func checkCheckpoints(txn Txn, block *Block) error {
+	if hash, ok := Params.CheckpointHash(block.Height); ok && hex.EncodeToString(block.Hash) != hash {
+		return blockError(block, ErrCheckpoint)
+	}
+	lastHash, err := getLastHash(txn)
+	if err != nil {
+		return err
+	}
+	tip, err := getBlock(txn, lastHash)
+	if err != nil {
+		return err
+	}
+	if block.Height <= Params.LastCheckpoint(tip.Height) {
+		return blockError(block, ErrCheckpointFork)
+	}
+	// The blocks a branch below the pruned height would disconnect have no
+	// transactions or undo data left.
+	prunedHeight, err := getPrunedHeight(txn)
+	if err != nil {
+		return err
+	}
+	if block.Height <= prunedHeight {
+		return blockError(block, ErrPrunedFork)
+	}
+	return nil
+}
+
+// assumedValid reports whether block is the assume-valid block or one of its
+// ancestors. That is only known once the assume-valid block is stored, as
+// blocks below its height on other branches must still be checked in full.
+func (bc *BlockChain) assumedValid(txn Txn, block *Block) (bool, error) {
+	if !Params.AssumedValid(block.Height) {
+		return false, nil
+	}
+	bc.assumeValidMu.Lock()
+	defer bc.assumeValidMu.Unlock()
+	if bc.assumeValidChain == nil {
+		hash, err := hex.DecodeString(Params.AssumeValid.Hash)
+		if err != nil {
+			return false, err
+		}
+		ancestor, err := getBlock(txn, hash)
+		if err == ErrKeyNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		chain := make([][]byte, ancestor.Height+1)
+		for {
+			chain[ancestor.Height] = ancestor.Hash
+			if len(ancestor.PrevHash) == 0 {
+				break
+			}
+			if ancestor, err = getBlock(txn, ancestor.PrevHash); err != nil {
+				return false, err
+			}
+		}
+		bc.assumeValidChain = chain
+	}
+	return bytes.Equal(bc.assumeValidChain[block.Height], block.Hash), nil
+}
+
+// awaitsAssumeValid reports whether block is below the height of the
+// assume-valid block while that block is not stored. Such a block is stored
+// but does not become the tip: once the assume-valid block arrives, its
+// ancestors are connected together and their signatures are skipped.
+func awaitsAssumeValid(txn Txn, block *Block) (bool, error) {
+	if Params.AssumeValid.Hash == "" || block.Height >= Params.AssumeValid.Height {
+		return false, nil
+	}
+	hash, err := hex.DecodeString(Params.AssumeValid.Hash)
+	if err != nil {
+		return false, err
+	}
+	if _, err := txn.Get(hash); err == ErrKeyNotFound {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// markInvalid records that the block with the given hash failed validation,
+// so that it and its descendants are rejected without being reconnected.
+func (bc *BlockChain) markInvalid(hash []byte) error {
+	return bc.Database.Update(func(txn Txn) error {
+		return txn.Set(prefixedKey(invalidPrefix, hash), []byte{})
+	})
+}
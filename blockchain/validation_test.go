@@ -0,0 +1,246 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/nthskyradiated/go-bc/wallet"
+)
+
+func TestCheckBlockRejectsBadHeaderFields(t *testing.T) {
+	coinbase := CoinbaseTx(string(wallet.MakeWallet().Address()), "", 0)
+
+	tests := []struct {
+		name   string
+		header BlockHeader
+		want   error
+	}{
+		{"difficulty above the maximum", BlockHeader{Version: BlockVersion, Difficulty: 300}, ErrBadDifficulty},
+		{"difficulty below the minimum", BlockHeader{Version: BlockVersion, Difficulty: -1}, ErrBadDifficulty},
+		{"unknown version", BlockHeader{Version: BlockVersion + 1, Difficulty: MinDifficulty}, ErrBadVersion},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			block := &Block{BlockHeader: test.header, Transactions: []*Transaction{coinbase}}
+			block.MerkleRoot = block.HashTransactions()
+			block.Hash = block.BlockHeader.Hash()
+			if err := CheckBlock(PoWEngine{}, block); !errors.Is(err, test.want) {
+				t.Errorf("CheckBlock = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestRejectOverwritingUnspentTransaction(t *testing.T) {
+	chain, alice := newTestChain(t)
+	address := string(alice.Address())
+	subsidy := Params.Subsidy(1)
+	if Params.Subsidy(2) != subsidy {
+		t.Fatal("the subsidy changes between the test blocks")
+	}
+
+	first := CoinbaseTx(address, "same data", subsidy)
+	if _, err := chain.MineBlock(t.Context(), []*Transaction{first}); err != nil {
+		t.Fatal(err)
+	}
+	duplicate := CoinbaseTx(address, "same data", subsidy)
+	if string(duplicate.ID) != string(first.ID) {
+		t.Fatal("the coinbase transactions have different IDs")
+	}
+	_, err := chain.MineBlock(t.Context(), []*Transaction{duplicate})
+	if !errors.Is(err, ErrOverwriteTx) {
+		t.Fatalf("MineBlock = %v, want %v", err, ErrOverwriteTx)
+	}
+	if got, want := balance(chain, alice), Params.Subsidy(0)+subsidy; got != want {
+		t.Errorf("alice has %d, want %d", got, want)
+	}
+}
+
+func TestRejectValueAboveMaxSupply(t *testing.T) {
+	chain, alice := newTestChain(t)
+	address := string(alice.Address())
+
+	tests := []struct {
+		name   string
+		values []int
+	}{
+		{"output above the supply", []int{Params.MaxSupply + 1}},
+		{"overflowing output", []int{math.MaxInt}},
+		{"outputs summing above the supply", []int{Params.MaxSupply, Params.MaxSupply}},
+		{"outputs overflowing", []int{math.MaxInt, math.MaxInt}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			coinbase := CoinbaseTx(address, "", 0)
+			coinbase.Outputs = nil
+			for _, value := range test.values {
+				coinbase.Outputs = append(coinbase.Outputs, *NewTXOutput(value, address))
+			}
+			coinbase.ID = coinbase.Hash()
+			_, err := chain.MineBlock(t.Context(), []*Transaction{coinbase})
+			if !errors.Is(err, ErrValueOutOfRange) {
+				t.Errorf("MineBlock = %v, want %v", err, ErrValueOutOfRange)
+			}
+		})
+	}
+}
+
+// A negative height would index the authorities out of range.
+func TestCheckBlockRejectsNegativeHeight(t *testing.T) {
+	key, pubKey := wallet.NewKeyPair()
+	poa, err := NewPoAEngine([][]byte{pubKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	poa.AddSigner(key)
+	block := &Block{
+		BlockHeader:  BlockHeader{Version: BlockVersion, Difficulty: MinDifficulty, Height: -1},
+		Transactions: []*Transaction{CoinbaseTx(string(wallet.MakeWallet().Address()), "", 0)},
+	}
+	block.MerkleRoot = block.HashTransactions()
+	block.Hash = block.BlockHeader.Hash()
+	if err := CheckBlock(poa, block); !errors.Is(err, ErrBadHeight) {
+		t.Errorf("CheckBlock = %v, want %v", err, ErrBadHeight)
+	}
+}
+
+func TestAssumeValidOnlyCoversAncestors(t *testing.T) {
+	chain, alice := newTestChain(t)
+	genesis := tip(t, chain)
+	a1 := mineTxs(t, chain, string(alice.Address()))
+	a2 := mineTxs(t, chain, string(alice.Address()))
+	fork := forkBlock(t, genesis, CoinbaseTx(string(alice.Address()), "", Params.Subsidy(1)))
+
+	saved := Params.AssumeValid
+	Params.AssumeValid = Checkpoint{Height: a2.Height, Hash: hex.EncodeToString(a2.Hash)}
+	t.Cleanup(func() { Params.AssumeValid = saved })
+
+	err := chain.Database.View(func(txn Txn) error {
+		for _, test := range []struct {
+			block *Block
+			want  bool
+		}{{a1, true}, {a2, true}, {fork, false}} {
+			got, err := chain.assumedValid(txn, test.block)
+			if err != nil {
+				return err
+			}
+			if got != test.want {
+				t.Errorf("assumedValid(block %d %x) = %v, want %v", test.block.Height, test.block.Hash, got, test.want)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Blocks without a parent used to reach the storage with an empty key,
+// which badger fails on.
+func TestRejectBlockWithoutParent(t *testing.T) {
+	db, err := OpenBadger(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	alice := wallet.MakeWallet()
+	chain, err := CreateBlockChain(db, string(alice.Address()), false, PoWEngine{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := tip(t, chain)
+	for _, height := range []int{5, 0} {
+		coinbase := CoinbaseTx(string(alice.Address()), "", Params.Subsidy(height))
+		block := NewBlock([]*Transaction{coinbase}, nil, height, genesis.Difficulty, genesis.Timestamp+1, PoWEngine{})
+		if err := chain.AddBlock(block); !errors.Is(err, ErrOrphanBlock) {
+			t.Errorf("AddBlock(height %d, no parent) = %v, want %v", height, err, ErrOrphanBlock)
+		}
+	}
+	if string(chain.LastHash) != string(genesis.Hash) {
+		t.Error("the tip moved")
+	}
+}
+
+// syncChain creates a chain in memory from genesis, like a new node does
+// before it syncs the blocks after it.
+func syncChain(t *testing.T, genesis *Block) *BlockChain {
+	t.Helper()
+	chain, err := createBlockChain(NewMemoryStorage(), genesis, PoWEngine{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = chain.Database.Update(func(txn Txn) error {
+		utxo := UTXOSet{chain}
+		return utxo.connect(txn, genesis)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain
+}
+
+func TestAssumeValidSkipsSignaturesDuringSync(t *testing.T) {
+	source, alice := newTestChain(t)
+	genesis := tip(t, source)
+	bob := wallet.MakeWallet()
+
+	// bob signs away alice's genesis output, which only a check of the
+	// signatures notices.
+	utxo := UTXOSet{source}
+	stolen := NewTransaction(alice, string(bob.Address()), 5, 0, 0, &utxo)
+	prevTXs, err := source.previousTransactions(stolen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stolen.Sign(bob.PrivateKey, prevTXs)
+	stolen.ID = stolen.Hash()
+
+	miner := string(wallet.MakeWallet().Address())
+	b1 := forkBlock(t, genesis, CoinbaseTx(miner, "", Params.Subsidy(1)), stolen)
+	b2 := forkBlock(t, b1, CoinbaseTx(miner, "", Params.Subsidy(2)))
+	b3 := forkBlock(t, b2, CoinbaseTx(miner, "", Params.Subsidy(3)))
+
+	if err := syncChain(t, genesis).AddBlock(b1); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("AddBlock without assume-valid = %v, want %v", err, ErrBadSignature)
+	}
+
+	saved := Params.AssumeValid
+	Params.AssumeValid = Checkpoint{Height: b2.Height, Hash: hex.EncodeToString(b2.Hash)}
+	t.Cleanup(func() { Params.AssumeValid = saved })
+
+	chain := syncChain(t, genesis)
+	if err := chain.AddBlock(b1); err != nil {
+		t.Fatal(err)
+	}
+	if chain.GetBestHeight() != 0 {
+		t.Fatal("a block below the missing assume-valid block became the tip")
+	}
+	for _, block := range []*Block{b2, b3} {
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(chain.LastHash) != string(b3.Hash) {
+		t.Fatalf("the tip is at height %d, want 3", chain.GetBestHeight())
+	}
+	if got := balance(chain, bob); got != 5 {
+		t.Errorf("bob has %d, want the 5 the skipped signature paid", got)
+	}
+
+	// A branch that does not lead to the assume-valid block is checked in
+	// full.
+	fork := syncChain(t, genesis)
+	c1 := forkBlock(t, genesis, CoinbaseTx(miner, "", Params.Subsidy(1)), stolen)
+	c2 := forkBlock(t, c1, CoinbaseTx(miner, "", Params.Subsidy(2)))
+	if err := fork.AddBlock(c1); err != nil {
+		t.Fatal(err)
+	}
+	if err := fork.AddBlock(c2); !errors.Is(err, ErrCheckpoint) {
+		t.Errorf("AddBlock of another block at the assume-valid height = %v, want %v", err, ErrCheckpoint)
+	}
+	if fork.GetBestHeight() != 0 {
+		t.Error("a branch that does not reach the assume-valid block became the tip")
+	}
+}
@@ -1,12 +1,17 @@
 package cli
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"github.com/nthskyradiated/go-bc/blockchain"
 	"github.com/nthskyradiated/go-bc/wallet"
 	"github.com/nthskyradiated/go-bc/network"
@@ -14,15 +19,30 @@ import (
 type CommandLine struct {}
 
 func (cli *CommandLine) printUsage() {
-	fmt.Println("Usage:")
+	fmt.Println("Usage: [-regtest] COMMAND")
+	fmt.Println("  -regtest runs the command on the regtest network, as does setting the NETWORK env. var. to regtest")
 	fmt.Println("  getbalance -address ADDRESS - Get balance of an address")
-	fmt.Println("  createblockchain -address ADDRESS - Create a blockchain and send genesis block reward to ADDRESS")
+	fmt.Println("  createblockchain -address ADDRESS [-txindex=false] [-authorities KEY,KEY,...] - Create a blockchain and send genesis block reward to ADDRESS. -authorities makes it a proof-of-authority chain signed in turn by the given wallet addresses or hex public keys")
 	fmt.Println("  print - Print the blockchain")
-	fmt.Println(" send -from FROM -to TO -amount AMOUNT -mine - Send amount of coins. Then -mine flag is set, mine off of this node")
+	fmt.Println(" send -from FROM -to TO -amount AMOUNT [-fee FEE] [-locktime LOCKTIME] [-workers N] -mine - Send amount of coins. Then -mine flag is set, mine off of this node")
 	fmt.Println("  createwallet - Create a new Wallet")
-	fmt.Println("  listaddresses - List the addresses in our wallet file")
-	fmt.Println("  reindexutxo - Rebuilds the UTXO set")
-	fmt.Println(" startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println("  listaddresses [-pubkeys] - List the addresses in our wallet file")
+	fmt.Println("  createmultisig -required M -keys KEY,KEY,... - Create an M-of-N address from wallet addresses or hex public keys")
+	fmt.Println("  reindexutxo - Rebuilds the UTXO set and the address index")
+	fmt.Println("  supply - Print the block subsidy and the coins issued so far")
+	fmt.Println("  rollback -height HEIGHT - Disconnect blocks until the tip is at HEIGHT")
+	fmt.Println("  invalidateblock -hash HASH - Mark a block invalid and disconnect it and its descendants")
+	fmt.Println("  history -address ADDRESS - List the transactions that paid or spent from ADDRESS")
+	fmt.Println("  reindextx - Rebuilds and enables the transaction index")
+	fmt.Println("  dumputxo -file FILE - Write the UTXO set at the tip and the header chain to FILE")
+	fmt.Println("  loadutxo -file FILE [-hash HASH] - Create the blockchain from a UTXO snapshot, checking its hash if given. startnode then validates the blocks below it")
+	fmt.Println("  exportblocks -file FILE - Write the blocks of the main chain to FILE in height order")
+	fmt.Println("  importblocks -file FILE - Validate and add the blocks in FILE written by exportblocks, creating the blockchain if needed")
+	fmt.Println("  prune -depth DEPTH - Keep the transactions of only the last DEPTH blocks, now and as the chain grows")
+	fmt.Println("  gettransaction -txid TXID - Print a transaction and the block containing it")
+	fmt.Println("  merkleproof -txid TXID - Print the merkle inclusion proof of a transaction")
+	fmt.Println("  generate -blocks N -address ADDRESS [-workers N] - Mine N blocks paying ADDRESS right away")
+	fmt.Println(" startnode -miner ADDRESS [-workers N] - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
 }
 
 func (cli *CommandLine) validateArgs() {
@@ -32,6 +52,24 @@ func (cli *CommandLine) validateArgs() {
 	}
 }
 
+// selectNetwork switches to the network named by the NETWORK env. var., or
+// to regtest if the command is preceded by -regtest, which is removed from
+// the arguments.
+func (cli *CommandLine) selectNetwork() {
+	name := os.Getenv("NETWORK")
+	if len(os.Args) > 1 && os.Args[1] == "-regtest" {
+		name = blockchain.RegTestParams.Name
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	if name == "" {
+		return
+	}
+	if err := blockchain.SelectNetwork(name); err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+}
+
 func (cli *CommandLine) StartNode(nodeId, minerAddress string) {
 	fmt.Printf("Starting Node %s\n", nodeId)
 
@@ -42,16 +80,59 @@ func (cli *CommandLine) StartNode(nodeId, minerAddress string) {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	network.StartServer(nodeId, minerAddress)
+	var signers []ecdsa.PrivateKey
+	if len(minerAddress) > 0 {
+		wallets, _ := wallet.NewWallets(nodeId)
+		signers = wallets.PrivateKeys()
+	}
+	network.StartServer(nodeId, minerAddress, signers)
 }
 
-func (cli *CommandLine) listAddresses(nodeId string) {
+func (cli *CommandLine) listAddresses(nodeId string, pubKeys bool) {
 	wallets, _ := wallet.NewWallets(nodeId)
 	addresses := wallets.GetAllAddresses()
 
 	for _, address := range addresses {
+		if pubKeys {
+			fmt.Printf("%s %x\n", address, wallets.GetWallet(address).PublicKey)
+			continue
+		}
 		fmt.Println(address)
 	}
+	for address, ms := range wallets.Multisigs {
+		fmt.Printf("%s (multisig %d-of-%d)\n", address, ms.Required, len(ms.PublicKeys))
+	}
+}
+
+// publicKeys resolves each of keys, a wallet address or a hex public key, to
+// a public key.
+func publicKeys(wallets *wallet.Wallets, keys []string) [][]byte {
+	var pubKeys [][]byte
+	for _, key := range keys {
+		if w, ok := wallets.Wallets[key]; ok {
+			pubKeys = append(pubKeys, w.PublicKey)
+			continue
+		}
+		pubKey, err := hex.DecodeString(key)
+		if err != nil {
+			log.Panicf("Key is neither a wallet address nor a hex public key: %s", key)
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+	return pubKeys
+}
+
+func (cli *CommandLine) createMultisig(required int, keys []string, nodeId string) {
+	wallets, _ := wallet.NewWallets(nodeId)
+
+	pubKeys := publicKeys(wallets, keys)
+	script, err := blockchain.MultisigScript(required, pubKeys)
+	blockchain.HandleError(err)
+
+	address := wallets.AddMultisig(&wallet.Multisig{Required: required, PublicKeys: pubKeys, RedeemScript: script})
+	wallets.SaveFile(nodeId)
+
+	fmt.Printf("New %d-of-%d multisig address is: %s\n", required, len(pubKeys), address)
 }
 
 
@@ -72,8 +153,11 @@ func (cli *CommandLine) printChain(nodeId string) {
 		block := iter.Next()
 		fmt.Printf("Prev. hash: %x\n", block.PrevHash)
 		fmt.Printf("Hash: %x\n", block.Hash)
-		pow := blockchain.NewProofOfWork(block)
-		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
+		fmt.Printf("Difficulty: %d\n", block.Difficulty)
+		fmt.Printf("Seal: %s\n", strconv.FormatBool(chain.Engine.VerifySeal(block) == nil))
+		if block.Pruned() {
+			fmt.Println("Transactions pruned")
+		}
 		for _, tx := range block.Transactions {
 			fmt.Println(tx)
 		}
@@ -84,11 +168,45 @@ func (cli *CommandLine) printChain(nodeId string) {
 	}
 }
 
-func (cli *CommandLine) createblockchain(address, nodeId string) {
+func (cli *CommandLine) merkleProof(txID, nodeId string) {
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panicf("Invalid transaction ID: %s", txID)
+	}
+	chain := blockchain.ContinueBlockChain(nodeId)
+	defer chain.Database.Close()
+
+	block, err := chain.FindTransactionBlock(id)
+	blockchain.HandleError(err)
+	proof, err := block.MerkleTree().Proof(id)
+	blockchain.HandleError(err)
+
+	fmt.Printf("Transaction: %x\n", id)
+	fmt.Printf("Block: %x (height %d)\n", block.Hash, block.Height)
+	fmt.Printf("Merkle root: %x\n", block.MerkleRoot)
+	for i, step := range proof {
+		side := "right"
+		if step.Left {
+			side = "left"
+		}
+		fmt.Printf("  %d: %-5s %x\n", i, side, step.Hash)
+	}
+	fmt.Printf("Valid: %s\n", strconv.FormatBool(blockchain.VerifyProof(block.MerkleRoot, id, proof)))
+}
+
+func (cli *CommandLine) createblockchain(address, nodeId string, txIndex bool, authorities []string) {
 		if !wallet.ValidateAddress(address) {
 		log.Panicf("Invalid address: %s", address)
 	}
-	chain := blockchain.NewBlockChain(address, nodeId)
+	var engine blockchain.Engine = blockchain.PoWEngine{}
+	if len(authorities) > 0 {
+		wallets, _ := wallet.NewWallets(nodeId)
+		poa, err := blockchain.NewPoAEngine(publicKeys(wallets, authorities))
+		blockchain.HandleError(err)
+		blockchain.AddSigners(poa, wallets.PrivateKeys())
+		engine = poa
+	}
+	chain := blockchain.NewBlockChain(address, nodeId, txIndex, engine)
 	defer chain.Database.Close()
 
 	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
@@ -106,6 +224,83 @@ func (cli *CommandLine) reindexUTXO(nodeId string) {
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
 }
 
+func (cli *CommandLine) reindexTx(nodeId string) {
+	chain := blockchain.ContinueBlockChain(nodeId)
+	defer chain.Database.Close()
+
+	count := chain.ReindexTransactions()
+	fmt.Printf("Done! There are %d transactions in the transaction index.\n", count)
+}
+
+func (cli *CommandLine) dumpUTXO(file, nodeId string) {
+	chain := blockchain.ContinueBlockChain(nodeId)
+	defer chain.Database.Close()
+
+	snapshot, err := chain.DumpUTXO(file)
+	blockchain.HandleError(err)
+	fmt.Printf("Wrote the UTXO set at height %d, block %x, to %s\n", snapshot.Height, snapshot.BaseHash, file)
+	fmt.Printf("Snapshot hash: %x\n", snapshot.Hash)
+}
+
+func (cli *CommandLine) loadUTXO(file, hash, nodeId string) {
+	expected, err := hex.DecodeString(hash)
+	if err != nil {
+		log.Panicf("Invalid snapshot hash: %s", hash)
+	}
+	chain, snapshot, err := blockchain.LoadUTXO(file, nodeId, expected)
+	blockchain.HandleError(err)
+	defer chain.Database.Close()
+
+	fmt.Printf("Loaded the UTXO set at height %d, block %x\n", snapshot.Height, snapshot.BaseHash)
+	fmt.Printf("Snapshot hash: %x\n", snapshot.Hash)
+	fmt.Println("The blocks below it are validated in the background once the node is started")
+}
+
+func (cli *CommandLine) exportBlocks(file, nodeId string) {
+	chain := blockchain.ContinueBlockChain(nodeId)
+	defer chain.Database.Close()
+
+	count, err := chain.ExportBlocks(file)
+	blockchain.HandleError(err)
+	fmt.Printf("Exported %d blocks to %s\n", count, file)
+}
+
+func (cli *CommandLine) importBlocks(file, nodeId string) {
+	chain, count, err := blockchain.ImportBlocks(file, nodeId)
+	if chain != nil {
+		defer chain.Database.Close()
+	}
+	if err != nil {
+		fmt.Printf("Imported %d blocks before failing\n", count)
+		log.Panic(err)
+	}
+	fmt.Printf("Imported %d blocks. The chain tip is at height %d.\n", count, chain.GetBestHeight())
+}
+
+func (cli *CommandLine) prune(depth int, nodeId string) {
+	chain := blockchain.ContinueBlockChain(nodeId)
+	defer chain.Database.Close()
+
+	err := chain.EnablePruning(depth)
+	blockchain.HandleError(err)
+	fmt.Printf("Pruning enabled. Blocks up to height %d have been pruned.\n", chain.PrunedHeight())
+}
+
+func (cli *CommandLine) getTransaction(txID, nodeId string) {
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panicf("Invalid transaction ID: %s", txID)
+	}
+	chain := blockchain.ContinueBlockChain(nodeId)
+	defer chain.Database.Close()
+
+	tx, block, err := chain.GetTransaction(id)
+	blockchain.HandleError(err)
+	confirmations := chain.GetBestHeight() - block.Height + 1
+	fmt.Printf("Block: %x (height %d, %d confirmations)\n", block.Hash, block.Height, confirmations)
+	fmt.Println(tx)
+}
+
 func (cli *CommandLine) getbalance(address, nodeId string) {
 	if !wallet.ValidateAddress(address) {
 		log.Panicf("Invalid address: %s", address)
@@ -114,17 +309,86 @@ func (cli *CommandLine) getbalance(address, nodeId string) {
 	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
 	defer chain.Database.Close()
 
-	balance := 0
 	pubKeyHash := wallet.Base58Decode([]byte(address))
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUnspentTransactions(pubKeyHash)
-	for _, out := range UTXOs {
-		balance += out.Value
-	}
+	balance, immature := UTXOSet.Balance(pubKeyHash)
 	fmt.Printf("Balance of %s: %d\n", address, balance)
+	if immature > 0 {
+		fmt.Printf("Immature coinbase: %d\n", immature)
+	}
+}
+
+func (cli *CommandLine) supply(nodeId string) {
+	chain := blockchain.ContinueBlockChain(nodeId)
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	defer chain.Database.Close()
+
+	params := blockchain.Params
+	height := chain.GetBestHeight()
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Next block subsidy: %d (halving every %d blocks)\n", params.Subsidy(height+1), params.HalvingInterval)
+	fmt.Printf("Issued by subsidies: %d of %d\n", params.TotalIssued(height), params.MaxSupply)
+	fmt.Printf("Unspent outputs: %d\n", UTXOSet.TotalValue())
+}
+
+func (cli *CommandLine) generate(blocks int, address, nodeId string) {
+	if !wallet.ValidateAddress(address) {
+		log.Panic("Address is not Valid")
+	}
+	chain := blockchain.ContinueBlockChain(nodeId)
+	defer chain.Database.Close()
+
+	wallets, _ := wallet.NewWallets(nodeId)
+	blockchain.AddSigners(chain.Engine, wallets.PrivateKeys())
+	for i := 0; i < blocks; i++ {
+		height := chain.GetBestHeight() + 1
+		cbTx := blockchain.CoinbaseTx(address, "", blockchain.Params.Subsidy(height))
+		block, err := chain.MineBlock(context.Background(), []*blockchain.Transaction{cbTx})
+		blockchain.HandleError(err)
+		fmt.Printf("Generated block %d: %x\n", block.Height, block.Hash)
+	}
 }
 
-func (cli *CommandLine) send(from, to string, amount int, nodeId string, mineNow bool) {
+func (cli *CommandLine) rollback(height int, nodeId string) {
+	chain := blockchain.ContinueBlockChain(nodeId)
+	defer chain.Database.Close()
+
+	err := chain.RollbackTo(height)
+	blockchain.HandleError(err)
+	fmt.Printf("Rolled back to height %d, tip is %x\n", height, chain.LastHash)
+}
+
+func (cli *CommandLine) invalidateBlock(blockHash, nodeId string) {
+	hash, err := hex.DecodeString(blockHash)
+	if err != nil {
+		log.Panicf("Invalid block hash: %s", blockHash)
+	}
+	chain := blockchain.ContinueBlockChain(nodeId)
+	defer chain.Database.Close()
+
+	err = chain.InvalidateBlock(hash)
+	blockchain.HandleError(err)
+	fmt.Printf("Block %x invalidated, tip is %x\n", hash, chain.LastHash)
+}
+
+func (cli *CommandLine) history(address, nodeId string) {
+	if !wallet.ValidateAddress(address) {
+		log.Panicf("Invalid address: %s", address)
+	}
+	chain := blockchain.ContinueBlockChain(nodeId)
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	defer chain.Database.Close()
+
+	pubKeyHash := wallet.Base58Decode([]byte(address))
+	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+	history := UTXOSet.AddressHistory(pubKeyHash)
+	fmt.Printf("History of %s: %d transactions\n", address, len(history))
+	for _, entry := range history {
+		fmt.Printf("  height %d  %x  %+d\n", entry.Height, entry.TxID, entry.Delta)
+	}
+}
+
+func (cli *CommandLine) send(from, to string, amount, fee int, lockTime uint, nodeId string, mineNow bool) {
 		if !wallet.ValidateAddress(to) {
 		log.Panic("Address is not Valid")	
 	}
@@ -139,14 +403,23 @@ func (cli *CommandLine) send(from, to string, amount int, nodeId string, mineNow
 	if err != nil {
 		log.Panic(err)
 	}
-	wallet := wallets.GetWallet(from)
-
-	tx := blockchain.NewTransaction(&wallet, to, amount, &UTXOSet)
+	blockchain.AddSigners(chain.Engine, wallets.PrivateKeys())
+	var tx *blockchain.Transaction
+	if ms, ok := wallets.GetMultisig(from); ok {
+		signers := wallets.Signers(ms)
+		if len(signers) < ms.Required {
+			log.Panicf("Wallet holds %d of the %d keys needed to spend from %s", len(signers), ms.Required, from)
+		}
+		tx = blockchain.NewMultisigTransaction(ms, signers, to, amount, fee, uint32(lockTime), &UTXOSet)
+	} else {
+		wallet := wallets.GetWallet(from)
+		tx = blockchain.NewTransaction(&wallet, to, amount, fee, uint32(lockTime), &UTXOSet)
+	}
 	if mineNow {
-		cbTx := blockchain.CoinbaseTx(from, "")
-		block := chain.MineBlock([]*blockchain.Transaction{cbTx, tx})
-		UTXOSet.Update(block)
-		
+		cbTx := blockchain.CoinbaseTx(from, "", blockchain.Params.Subsidy(chain.GetBestHeight()+1)+fee)
+		_, err := chain.MineBlock(context.Background(), []*blockchain.Transaction{cbTx, tx})
+		blockchain.HandleError(err)
+
 		} else {
 			network.SendTx(network.KnownNodes[0], tx)
 			fmt.Println("send tx")
@@ -155,6 +428,7 @@ func (cli *CommandLine) send(from, to string, amount int, nodeId string, mineNow
 }
 
 func (cli *CommandLine) Run() {
+	cli.selectNetwork()
 	cli.validateArgs()
 		nodeID := os.Getenv("NODE_ID")
 	if nodeID == "" {
@@ -167,16 +441,53 @@ func (cli *CommandLine) Run() {
 	printChainCmd := flag.NewFlagSet("print", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
+	createMultisigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	supplyCmd := flag.NewFlagSet("supply", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	merkleProofCmd := flag.NewFlagSet("merkleproof", flag.ExitOnError)
+	reindexTxCmd := flag.NewFlagSet("reindextx", flag.ExitOnError)
+	historyCmd := flag.NewFlagSet("history", flag.ExitOnError)
+	rollbackCmd := flag.NewFlagSet("rollback", flag.ExitOnError)
+	invalidateBlockCmd := flag.NewFlagSet("invalidateblock", flag.ExitOnError)
+	getTransactionCmd := flag.NewFlagSet("gettransaction", flag.ExitOnError)
+	pruneCmd := flag.NewFlagSet("prune", flag.ExitOnError)
+	dumpUTXOCmd := flag.NewFlagSet("dumputxo", flag.ExitOnError)
+	loadUTXOCmd := flag.NewFlagSet("loadutxo", flag.ExitOnError)
+	exportBlocksCmd := flag.NewFlagSet("exportblocks", flag.ExitOnError)
+	importBlocksCmd := flag.NewFlagSet("importblocks", flag.ExitOnError)
+	generateCmd := flag.NewFlagSet("generate", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "Address to get balance of")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "Address to send genesis block reward to")
+	createBlockchainTxIndex := createBlockchainCmd.Bool("txindex", true, "Maintain an index of transactions by ID")
+	createBlockchainAuthorities := createBlockchainCmd.String("authorities", "", "Comma separated wallet addresses or hex public keys of the block signers, in turn order")
 	sendFrom := sendCmd.String("from", "", "Address to send from")
 	sendTo := sendCmd.String("to", "", "Address to send to")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendFee := sendCmd.Int("fee", 0, "Fee left to the miner of the transaction")
+	sendWorkers := sendCmd.Int("workers", blockchain.MiningWorkers, "Number of goroutines used to mine")
+	sendLockTime := sendCmd.Uint("locktime", 0, "Block height, or Unix time from 500000000 on, before which the transaction cannot be mined")
+	listAddressesPubKeys := listAddressesCmd.Bool("pubkeys", false, "Print the public key of each address")
+	createMultisigRequired := createMultisigCmd.Int("required", 0, "Number of signatures needed to spend")
+	createMultisigKeys := createMultisigCmd.String("keys", "", "Comma separated wallet addresses or hex public keys")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodeWorkers := startNodeCmd.Int("workers", blockchain.MiningWorkers, "Number of goroutines used to mine")
+	merkleProofTxID := merkleProofCmd.String("txid", "", "ID of the transaction to prove")
+	rollbackHeight := rollbackCmd.Int("height", -1, "Height of the new tip")
+	invalidateBlockHash := invalidateBlockCmd.String("hash", "", "Hash of the block to invalidate")
+	historyAddress := historyCmd.String("address", "", "Address to list the history of")
+	dumpUTXOFile := dumpUTXOCmd.String("file", "", "File to write the snapshot to")
+	loadUTXOFile := loadUTXOCmd.String("file", "", "Snapshot file to load")
+	loadUTXOHash := loadUTXOCmd.String("hash", "", "Expected snapshot hash")
+	exportBlocksFile := exportBlocksCmd.String("file", "", "File to write the blocks to")
+	importBlocksFile := importBlocksCmd.String("file", "", "File to read the blocks from")
+	generateBlocks := generateCmd.Int("blocks", 1, "Number of blocks to mine")
+	generateAddress := generateCmd.String("address", "", "Address the block rewards are paid to")
+	generateWorkers := generateCmd.Int("workers", blockchain.MiningWorkers, "Number of goroutines used to mine")
+	pruneDepth := pruneCmd.Int("depth", 0, "Number of latest blocks that keep their transactions")
+	getTransactionTxID := getTransactionCmd.String("txid", "", "ID of the transaction to look up")
 
 	switch os.Args[1] {
 	case "getbalance":
@@ -204,11 +515,21 @@ func (cli *CommandLine) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "supply":
+		err := supplyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "createwallet":
 		err := createWalletCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "createmultisig":
+		err := createMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "print":
 		err := printChainCmd.Parse(os.Args[2:])
 		blockchain.HandleError(err)
@@ -217,6 +538,66 @@ func (cli *CommandLine) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "merkleproof":
+		err := merkleProofCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "rollback":
+		err := rollbackCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "invalidateblock":
+		err := invalidateBlockCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "history":
+		err := historyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "reindextx":
+		err := reindexTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "gettransaction":
+		err := getTransactionCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "prune":
+		err := pruneCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "dumputxo":
+		err := dumpUTXOCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "loadutxo":
+		err := loadUTXOCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "exportblocks":
+		err := exportBlocksCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "importblocks":
+		err := importBlocksCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "generate":
+		err := generateCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.printUsage()
 		runtime.Goexit()
@@ -235,7 +616,11 @@ func (cli *CommandLine) Run() {
 			createBlockchainCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.createblockchain(*createBlockchainAddress, nodeID)
+		var authorities []string
+		if *createBlockchainAuthorities != "" {
+			authorities = strings.Split(*createBlockchainAuthorities, ",")
+		}
+		cli.createblockchain(*createBlockchainAddress, nodeID, *createBlockchainTxIndex, authorities)
 		fmt.Printf("Creating blockchain with genesis block reward to %s\n", nodeID)
 	}
 
@@ -246,27 +631,134 @@ func (cli *CommandLine) Run() {
 		cli.createWallet(nodeID)
 	}
 	if listAddressesCmd.Parsed() {
-		cli.listAddresses(nodeID)
+		cli.listAddresses(nodeID, *listAddressesPubKeys)
+	}
+
+	if createMultisigCmd.Parsed() {
+		if *createMultisigRequired <= 0 || *createMultisigKeys == "" {
+			createMultisigCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.createMultisig(*createMultisigRequired, strings.Split(*createMultisigKeys, ","), nodeID)
 	}
 
 	if reindexUTXOCmd.Parsed() {
 		cli.reindexUTXO(nodeID)
 	}
+
+	if supplyCmd.Parsed() {
+		cli.supply(nodeID)
+	}
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 || *sendLockTime > math.MaxUint32 || *sendWorkers <= 0 {
 			sendCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		blockchain.MiningWorkers = *sendWorkers
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, *sendLockTime, nodeID, *sendMine)
+	}
+
+	if rollbackCmd.Parsed() {
+		if *rollbackHeight < 0 {
+			rollbackCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.rollback(*rollbackHeight, nodeID)
+	}
+
+	if invalidateBlockCmd.Parsed() {
+		if *invalidateBlockHash == "" {
+			invalidateBlockCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.invalidateBlock(*invalidateBlockHash, nodeID)
+	}
+
+	if historyCmd.Parsed() {
+		if *historyAddress == "" {
+			historyCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.history(*historyAddress, nodeID)
+	}
+
+	if reindexTxCmd.Parsed() {
+		cli.reindexTx(nodeID)
+	}
+
+	if dumpUTXOCmd.Parsed() {
+		if *dumpUTXOFile == "" {
+			dumpUTXOCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.dumpUTXO(*dumpUTXOFile, nodeID)
+	}
+
+	if loadUTXOCmd.Parsed() {
+		if *loadUTXOFile == "" {
+			loadUTXOCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.loadUTXO(*loadUTXOFile, *loadUTXOHash, nodeID)
+	}
+
+	if exportBlocksCmd.Parsed() {
+		if *exportBlocksFile == "" {
+			exportBlocksCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.exportBlocks(*exportBlocksFile, nodeID)
+	}
+
+	if importBlocksCmd.Parsed() {
+		if *importBlocksFile == "" {
+			importBlocksCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.importBlocks(*importBlocksFile, nodeID)
+	}
+
+	if generateCmd.Parsed() {
+		if *generateAddress == "" || *generateBlocks <= 0 || *generateWorkers <= 0 {
+			generateCmd.Usage()
+			runtime.Goexit()
+		}
+		blockchain.MiningWorkers = *generateWorkers
+		cli.generate(*generateBlocks, *generateAddress, nodeID)
+	}
+
+	if pruneCmd.Parsed() {
+		if *pruneDepth < blockchain.MinPruneDepth {
+			pruneCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.prune(*pruneDepth, nodeID)
+	}
+
+	if getTransactionCmd.Parsed() {
+		if *getTransactionTxID == "" {
+			getTransactionCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.getTransaction(*getTransactionTxID, nodeID)
+	}
+
+	if merkleProofCmd.Parsed() {
+		if *merkleProofTxID == "" {
+			merkleProofCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.merkleProof(*merkleProofTxID, nodeID)
 	}
 
 	if startNodeCmd.Parsed() {
 		nodeID := os.Getenv("NODE_ID")
 		fmt.Printf("Starting node with ID: %s\n", nodeID)
-		if nodeID == "" {
+		if nodeID == "" || *startNodeWorkers <= 0 {
 			startNodeCmd.Usage()
 			runtime.Goexit()
 		}
+		blockchain.MiningWorkers = *startNodeWorkers
 		cli.StartNode(nodeID, *startNodeMiner)
 	}
 }
\ No newline at end of file
@@ -2,8 +2,11 @@ package network
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -12,6 +15,8 @@ import (
 	"runtime"
 	"syscall"
 	"slices"
+	"sync"
+	"time"
 	"github.com/nthskyradiated/go-bc/blockchain"
 	DEATH "github.com/vrecan/death/v3"
 )
@@ -28,6 +33,14 @@ var (
 	KnownNodes      = []string{"localhost:3000"}
 	blocksInTransit = [][]byte{}
 	memoryPool      = make(map[string]blockchain.Transaction)
+
+	// poolMu guards memoryPool, which handlers and the miner share.
+	poolMu sync.Mutex
+
+	// stopMining cancels the block being mined. It is set while a miner
+	// runs, so only one runs at a time.
+	miningMu   sync.Mutex
+	stopMining context.CancelFunc
 )
 
 type Addr struct {
@@ -55,6 +68,14 @@ type Inv struct {
 	Items    [][]byte
 }
 
+// NotFound answers a getdata request for data the node does not have, such
+// as a block whose transactions it has pruned.
+type NotFound struct {
+	AddrFrom string
+	Type     string
+	ID       []byte
+}
+
 type Tx struct {
 	AddrFrom    string
 	Transaction []byte
@@ -64,6 +85,8 @@ type Version struct {
 	Version    int
 	BestHeight int
 	AddrFrom   string
+	// Timestamp is the sender's clock, used to adjust ours.
+	Timestamp int64
 }
 
 func CmdToBytes(cmd string) []byte {
@@ -163,6 +186,13 @@ func SendGetData(address, kind string, id []byte) {
 	SendData(address, request)
 }
 
+func SendNotFound(address, kind string, id []byte) {
+	payload := GobEncode(NotFound{nodeAddress, kind, id})
+	request := append(CmdToBytes("notfound"), payload...)
+
+	SendData(address, request)
+}
+
 func SendTx(addr string, tnx *blockchain.Transaction) {
 	data := Tx{nodeAddress, tnx.Serialize()}
 	payload := GobEncode(data)
@@ -173,7 +203,7 @@ func SendTx(addr string, tnx *blockchain.Transaction) {
 
 func SendVersion(addr string, chain *blockchain.BlockChain) {
 	bestHeight := chain.GetBestHeight()
-	payload := GobEncode(Version{version, bestHeight, nodeAddress})
+	payload := GobEncode(Version{version, bestHeight, nodeAddress, time.Now().Unix()})
 
 	request := append(CmdToBytes("version"), payload...)
 
@@ -209,21 +239,25 @@ func HandleBlock(request []byte, chain *blockchain.BlockChain) {
 	}
 
 	blockData := payload.Block
-	block := blockchain.Deserialize(blockData)
+	block, err := blockchain.DecodeBlock(blockData)
 
 	fmt.Println("Recevied a new block!")
-	chain.AddBlock(block)
-
-	fmt.Printf("Added block %x\n", block.Hash)
+	if err != nil {
+		fmt.Printf("Dropped malformed block: %v\n", err)
+	} else if err := chain.AddBlock(block); err != nil {
+		fmt.Printf("Rejected block: %v\n", err)
+	} else {
+		fmt.Printf("Added block %x\n", block.Hash)
+		if bytes.Equal(chain.LastHash, block.Hash) {
+			abortMining()
+		}
+	}
 
 	if len(blocksInTransit) > 0 {
 		blockHash := blocksInTransit[0]
 		SendGetData(payload.AddrFrom, "block", blockHash)
 
 		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := blockchain.UTXOSet{Blockchain: chain}
-		UTXOSet.Reindex()
 	}
 }
 
@@ -241,24 +275,30 @@ func HandleInv(request []byte, chain *blockchain.BlockChain) {
 	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
 
 	if payload.Type == "block" {
-		blocksInTransit = payload.Items
-
-		blockHash := payload.Items[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
-
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+		// Inventories list the tip first; request parents before children
+		// so every block can be linked to its branch when it arrives.
+		blocksInTransit = [][]byte{}
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			if chain.NeedsBlock(payload.Items[i]) {
+				blocksInTransit = append(blocksInTransit, payload.Items[i])
 			}
 		}
-		blocksInTransit = newInTransit
+		if len(blocksInTransit) == 0 {
+			return
+		}
+
+		blockHash := blocksInTransit[0]
+		SendGetData(payload.AddrFrom, "block", blockHash)
+		blocksInTransit = blocksInTransit[1:]
 	}
 
 	if payload.Type == "tx" {
 		txID := payload.Items[0]
 
-		if memoryPool[hex.EncodeToString(txID)].ID == nil {
+		poolMu.Lock()
+		_, pooled := memoryPool[hex.EncodeToString(txID)]
+		poolMu.Unlock()
+		if !pooled {
 			SendGetData(payload.AddrFrom, "tx", txID)
 		}
 	}
@@ -295,18 +335,43 @@ func HandleGetData(request []byte, chain *blockchain.BlockChain) {
 		if err != nil {
 			return
 		}
+		if block.Pruned() {
+			SendNotFound(payload.AddrFrom, "block", payload.ID)
+			return
+		}
 
 		SendBlock(payload.AddrFrom, &block)
 	}
 
 	if payload.Type == "tx" {
 		txID := hex.EncodeToString(payload.ID)
+		poolMu.Lock()
 		tx := memoryPool[txID]
+		poolMu.Unlock()
 
 		SendTx(payload.AddrFrom, &tx)
 	}
 }
 
+// HandleNotFound gives up on the blocks in transit when the peer has pruned
+// the one requested, since none after it could be connected.
+func HandleNotFound(request []byte) {
+	var buff bytes.Buffer
+	var payload NotFound
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Peer %s does not have %s %x\n", payload.AddrFrom, payload.Type, payload.ID)
+	if payload.Type == "block" {
+		blocksInTransit = [][]byte{}
+	}
+}
+
 func HandleTx(request []byte, chain *blockchain.BlockChain) {
 	var buff bytes.Buffer
 	var payload Tx
@@ -319,10 +384,30 @@ func HandleTx(request []byte, chain *blockchain.BlockChain) {
 	}
 
 	txData := payload.Transaction
-	tx := blockchain.DeserializeTransaction(txData)
+	tx, err := blockchain.DecodeTransaction(txData)
+	if err != nil {
+		fmt.Printf("Dropped malformed transaction: %v\n", err)
+		return
+	}
+	if !chain.IsFinalTx(&tx) {
+		fmt.Printf("Rejected transaction %x: lock time %d has not passed\n", tx.ID, tx.LockTime)
+		return
+	}
+	if !chain.VerifyTransaction(&tx) {
+		fmt.Printf("Rejected transaction %x: invalid or spends immature coinbase outputs\n", tx.ID)
+		return
+	}
+	poolMu.Lock()
+	if conflict := poolConflict(&tx); conflict != "" {
+		poolMu.Unlock()
+		fmt.Printf("Rejected transaction %x: spends an output already spent by %s\n", tx.ID, conflict)
+		return
+	}
 	memoryPool[hex.EncodeToString(tx.ID)] = tx
+	pooled := len(memoryPool)
+	poolMu.Unlock()
 
-	fmt.Printf("%s, %d", nodeAddress, len(memoryPool))
+	fmt.Printf("%s, %d", nodeAddress, pooled)
 
 	if nodeAddress == KnownNodes[0] {
 		for _, node := range KnownNodes {
@@ -331,54 +416,153 @@ func HandleTx(request []byte, chain *blockchain.BlockChain) {
 			}
 		}
 	} else {
-		if len(memoryPool) >= 2 && len(mineAddress) > 0 {
+		if pooled >= 2 && len(mineAddress) > 0 {
 			MineTx(chain)
 		}
 	}
 }
 
+// poolConflict returns the ID of a transaction in the memory pool that spends
+// an output tx also spends, or "" if there is none. The caller holds poolMu.
+func poolConflict(tx *blockchain.Transaction) string {
+	for id, pooled := range memoryPool {
+		if id == hex.EncodeToString(tx.ID) {
+			continue
+		}
+		for _, in := range pooled.Inputs {
+			for _, other := range tx.Inputs {
+				if bytes.Equal(in.ID, other.ID) && in.OutIndex == other.OutIndex {
+					return id
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// MineTx mines a block from the memory pool and announces it, repeating
+// while transactions are left. One block is mined at a time: a call made
+// while another is mining returns at once, leaving the transactions it was
+// called for to the running miner.
 func MineTx(chain *blockchain.BlockChain) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	miningMu.Lock()
+	if stopMining != nil {
+		miningMu.Unlock()
+		return
+	}
+	stopMining = cancel
+	miningMu.Unlock()
+
+	again := mineBlock(ctx, chain)
+
+	miningMu.Lock()
+	stopMining = nil
+	miningMu.Unlock()
+	if again && poolSize() > 0 {
+		MineTx(chain)
+	}
+}
+
+// mineBlock mines one block from the memory pool, stopping when ctx is
+// cancelled. It reports whether mining should go on with the transactions
+// left in the pool.
+func mineBlock(ctx context.Context, chain *blockchain.BlockChain) bool {
 	var txs []*blockchain.Transaction
+	var fees []int
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
 
-	for id := range memoryPool {
-		fmt.Printf("tx: %s\n", memoryPool[id].ID)
-		tx := memoryPool[id]
-		if chain.VerifyTransaction(&tx) {
-			txs = append(txs, &tx)
+	for _, tx := range poolTransactions() {
+		fmt.Printf("tx: %s\n", tx.ID)
+		if !chain.IsFinalTx(&tx) || !chain.VerifyTransaction(&tx) {
+			continue
 		}
+		fee, err := UTXOSet.Fee(&tx)
+		if err != nil || fee < 0 {
+			continue
+		}
+		fees = append(fees, fee)
+		txs = append(txs, &tx)
 	}
 
 	if len(txs) == 0 {
 		fmt.Println("All Transactions are invalid")
-		return
+		return false
 	}
 
-	cbTx := blockchain.CoinbaseTx(mineAddress, "")
-	txs = append(txs, cbTx)
+	txs, totalFee := blockchain.SelectTransactions(txs, fees)
+	cbTx := blockchain.CoinbaseTx(mineAddress, "", blockchain.Params.Subsidy(chain.GetBestHeight()+1)+totalFee)
+	txs = append([]*blockchain.Transaction{cbTx}, txs...)
 
-	newBlock := chain.MineBlock(txs)
-	UTXOSet  := blockchain.UTXOSet{Blockchain: chain}
-	UTXOSet.Reindex()
+	newBlock, err := chain.MineBlock(ctx, txs)
+	if errors.Is(err, context.Canceled) {
+		fmt.Println("Mining aborted: the chain tip changed")
+		return true
+	}
+	if err != nil {
+		fmt.Printf("Could not mine block: %v\n", err)
+		// Drop the transaction that made the block invalid, or every
+		// later attempt would fail the same way.
+		var txErr *blockchain.TxError
+		if errors.As(err, &txErr) {
+			txID := hex.EncodeToString(txErr.ID)
+			poolMu.Lock()
+			defer poolMu.Unlock()
+			if _, pooled := memoryPool[txID]; pooled {
+				delete(memoryPool, txID)
+				return true
+			}
+		}
+		return false
+	}
 
 	fmt.Println("New Block mined")
 
+	poolMu.Lock()
 	for _, tx := range txs {
 		txID := hex.EncodeToString(tx.ID)
 		delete(memoryPool, txID)
 	}
+	poolMu.Unlock()
 
 	for _, node := range KnownNodes {
 		if node != nodeAddress {
 			SendInv(node, "block", [][]byte{newBlock.Hash})
 		}
 	}
+	return true
+}
 
-	if len(memoryPool) > 0 {
-		MineTx(chain)
+// poolTransactions returns a copy of the transactions in the memory pool.
+func poolTransactions() []blockchain.Transaction {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	txs := make([]blockchain.Transaction, 0, len(memoryPool))
+	for _, tx := range memoryPool {
+		txs = append(txs, tx)
+	}
+	return txs
+}
+
+func poolSize() int {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	return len(memoryPool)
+}
+
+// abortMining cancels the block being mined, if any. The miner keeps its
+// turn until MineBlock has returned.
+func abortMining() {
+	miningMu.Lock()
+	defer miningMu.Unlock()
+	if stopMining != nil {
+		stopMining()
 	}
 }
 
-func HandleVersion(request []byte, chain *blockchain.BlockChain) {
+// HandleVersion handles a version message received from the host peerHost.
+func HandleVersion(request []byte, peerHost string, chain *blockchain.BlockChain) {
 	var buff bytes.Buffer
 	var payload Version
 
@@ -389,6 +573,10 @@ func HandleVersion(request []byte, chain *blockchain.BlockChain) {
 		log.Panic(err)
 	}
 
+	if payload.Timestamp != 0 {
+		blockchain.AddTimeSample(peerHost, payload.Timestamp)
+	}
+
 	bestHeight := chain.GetBestHeight()
 	otherHeight := payload.BestHeight
 
@@ -423,17 +611,25 @@ func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) {
 		HandleGetBlocks(req, chain)
 	case "getdata":
 		HandleGetData(req, chain)
+	case "notfound":
+		HandleNotFound(req)
 	case "tx":
 		HandleTx(req, chain)
 	case "version":
-		HandleVersion(req, chain)
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			host = conn.RemoteAddr().String()
+		}
+		HandleVersion(req, host, chain)
 	default:
 		fmt.Println("Unknown command")
 	}
 
 }
 
-func StartServer(nodeID, minerAddress string) {
+// StartServer runs the node. On proof-of-authority chains the node seals
+// blocks with those of signers that belong to an authority.
+func StartServer(nodeID, minerAddress string, signers []ecdsa.PrivateKey) {
 	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
 	mineAddress = minerAddress
 	ln, err := net.Listen(protocol, nodeAddress)
@@ -445,9 +641,18 @@ func StartServer(nodeID, minerAddress string) {
 	chain := blockchain.ContinueBlockChain(nodeID)
 	defer chain.Database.Close()
 	go CloseDB(chain)
+	blockchain.AddSigners(chain.Engine, signers)
+	if failed := chain.StartHistoryValidation(nodeID); failed != nil {
+		go StopOnHistoryFailure(failed, chain)
+	}
 
 	if nodeAddress != KnownNodes[0] {
 		SendVersion(KnownNodes[0], chain)
+		// A node loaded from a UTXO snapshot also needs the blocks below
+		// the snapshot, to validate its history.
+		if chain.PendingSnapshot() != nil {
+			SendGetBlocks(KnownNodes[0])
+		}
 	}
 	for {
 		conn, err := ln.Accept()
@@ -474,6 +679,17 @@ func GobEncode(data interface{}) []byte {
 func NodeIsKnown(addr string) bool {
 	return slices.Contains(KnownNodes, addr)
 }
+// StopOnHistoryFailure stops the node if history validation fails: its
+// UTXO set cannot be trusted for mining or relaying.
+func StopOnHistoryFailure(failed <-chan error, chain *blockchain.BlockChain) {
+	if err := <-failed; err != nil {
+		fmt.Printf("History validation failed: %v\n", err)
+		fmt.Println("The UTXO snapshot cannot be trusted, stopping the node")
+		chain.Database.Close()
+		os.Exit(1)
+	}
+}
+
 func CloseDB(chain *blockchain.BlockChain) {
 	d := DEATH.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 
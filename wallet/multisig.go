@@ -0,0 +1,43 @@
+package wallet
+
+import "bytes"
+
+// Multisig is an M-of-N address. Its outputs are locked to the hash of
+// RedeemScript and spending them needs signatures from Required of the
+// PublicKeys.
+type Multisig struct {
+	Required     int
+	PublicKeys   [][]byte
+	RedeemScript []byte
+}
+
+func (ms Multisig) Address() []byte {
+	return ScriptAddress(ms.RedeemScript)
+}
+
+// AddMultisig stores ms and returns its address.
+func (ws *Wallets) AddMultisig(ms *Multisig) string {
+	address := string(ms.Address())
+	ws.Multisigs[address] = ms
+	return address
+}
+
+func (ws Wallets) GetMultisig(address string) (*Multisig, bool) {
+	ms, ok := ws.Multisigs[address]
+	return ms, ok
+}
+
+// Signers returns the wallets holding keys of ms, in the order the keys
+// appear in its redeem script.
+func (ws Wallets) Signers(ms *Multisig) []*Wallet {
+	var signers []*Wallet
+	for _, pubKey := range ms.PublicKeys {
+		for _, w := range ws.Wallets {
+			if bytes.Equal(w.PublicKey, pubKey) {
+				signers = append(signers, w)
+				break
+			}
+		}
+	}
+	return signers
+}
@@ -0,0 +1,29 @@
+package wallet
+
+// Network holds the settings of wallets that differ between networks.
+type Network struct {
+	// Version prefixes addresses paying to a public key hash, and
+	// ScriptVersion those paying to the hash of a script.
+	Version       byte
+	ScriptVersion byte
+	// WalletFile is the path of a node's wallet file, formatted with the
+	// node ID.
+	WalletFile string
+}
+
+var MainNet = Network{
+	Version:       0x00,
+	ScriptVersion: 0x05,
+	WalletFile:    "./tmp/wallets_%s.data",
+}
+
+// RegTest uses other prefixes than MainNet so addresses cannot be mixed up
+// between the networks.
+var RegTest = Network{
+	Version:       0x6f,
+	ScriptVersion: 0xc4,
+	WalletFile:    "./tmp/regtest_wallets_%s.data",
+}
+
+// Net is the network wallets are used on.
+var Net = &MainNet
@@ -13,10 +13,7 @@ import (
 	"golang.org/x/crypto/ripemd160"
 )
 
-const (
-	checksumLength = 4
-	version        = byte(0x00)
-)
+const checksumLength = 4
 
 type Wallet struct {
 	PrivateKey ecdsa.PrivateKey
@@ -31,12 +28,26 @@ type WalletGob struct {
 
 func (w Wallet) Address() []byte {
 	publicKeyHash := PublicKeyHash(w.PublicKey)
-	versionedPayload := append([]byte{version}, publicKeyHash...)
+	return encodeAddress(Net.Version, publicKeyHash)
+}
+
+// ScriptAddress returns the address of outputs locked to the hash of script.
+func ScriptAddress(script []byte) []byte {
+	return encodeAddress(Net.ScriptVersion, PublicKeyHash(script))
+}
+
+// IsScriptAddress reports whether address pays to a script hash rather than
+// a public key hash.
+func IsScriptAddress(address []byte) bool {
+	payload := Base58Decode(address)
+	return len(payload) > 0 && payload[0] == Net.ScriptVersion
+}
+
+func encodeAddress(version byte, hash []byte) []byte {
+	versionedPayload := append([]byte{version}, hash...)
 	checksum := Checksum(versionedPayload)
 	fullPayload := append(versionedPayload, checksum...)
-	address := Base58Encode(fullPayload)
-
-	return address
+	return Base58Encode(fullPayload)
 }
 
 func ValidateAddress(address string) bool {
@@ -45,6 +56,9 @@ func ValidateAddress(address string) bool {
 	version := pubKeyHash[0]
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-checksumLength]
 	targetChecksum := Checksum(append([]byte{version}, pubKeyHash...))
+	if version != Net.Version && version != Net.ScriptVersion {
+		return false
+	}
 	return bytes.Equal(actualChecksum, targetChecksum)
 
 }
@@ -2,6 +2,7 @@ package wallet
 
 import (
 	"bytes"
+	"crypto/ecdsa"
 	"crypto/elliptic"
 	"encoding/gob"
 	"fmt"
@@ -9,15 +10,15 @@ import (
 	"os"
 )
 
-const walletFile = "./tmp/wallets_%s.data"
-
 type Wallets struct {
-	Wallets map[string]*Wallet
+	Wallets   map[string]*Wallet
+	Multisigs map[string]*Multisig
 }
 
 func NewWallets(nodeId string) (*Wallets, error) {
 	ws := Wallets{}
 	ws.Wallets = make(map[string]*Wallet)
+	ws.Multisigs = make(map[string]*Multisig)
 	err := ws.LoadFile(nodeId)
 	return &ws, err
 
@@ -42,8 +43,17 @@ func (ws Wallets) GetWallet(address string) Wallet {
 	return *ws.Wallets[address]
 }
 
+// PrivateKeys returns the private key of every wallet.
+func (ws Wallets) PrivateKeys() []ecdsa.PrivateKey {
+	var keys []ecdsa.PrivateKey
+	for _, w := range ws.Wallets {
+		keys = append(keys, w.PrivateKey)
+	}
+	return keys
+}
+
 func (ws *Wallets) LoadFile(nodeId string) error {
-	walletFile := fmt.Sprintf(walletFile, nodeId)
+	walletFile := fmt.Sprintf(Net.WalletFile, nodeId)
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
 		return err
 	}
@@ -64,13 +74,16 @@ func (ws *Wallets) LoadFile(nodeId string) error {
 	}
 
 	ws.Wallets = wallets.Wallets
+	if wallets.Multisigs != nil {
+		ws.Multisigs = wallets.Multisigs
+	}
 
 	return nil
 }
 
 func (ws *Wallets) SaveFile(nodeId string) {
 	var content bytes.Buffer
-	walletFile := fmt.Sprintf(walletFile, nodeId)
+	walletFile := fmt.Sprintf(Net.WalletFile, nodeId)
 
 	// Change gob.Register to use an exported type.
 	gob.Register(&elliptic.CurveParams{})